@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// encodeBase64 encodes the incoming payload with base64_encode set, so that
+// binary payloads can be transformed as text, e.g. into a JSON field.
+func (r Remap) encodeBase64(payload string) string {
+	if !r.Base64Encode {
+		return payload
+	}
+	return base64.StdEncoding.EncodeToString([]byte(payload))
+}
+
+// decodeBase64 decodes the remapped payload with base64_decode set, once
+// every text transform is done so the decoded bytes are published as they
+// are.
+func (r Remap) decodeBase64(payload string) (string, error) {
+	if !r.Base64Decode {
+		return payload, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(payload))
+	if err != nil {
+		return "", fmt.Errorf("payload is not valid base64: %s", err)
+	}
+	return string(decoded), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestBase64Encode(t *testing.T) {
+	remap := testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+base64_encode = true
+template = '{"image":"{{.Payload}}"}'
+`)
+	checkRemap(t, remap, []remapTest{
+		{"\x00\xff\x10", `{"image":"AP8Q"}`},
+		{"", `{"image":""}`},
+	})
+}
+
+func TestBase64Decode(t *testing.T) {
+	remap := testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+field = "image"
+base64_decode = true
+`)
+	checkRemap(t, remap, []remapTest{
+		{`{"image":"AP8Q"}`, "\x00\xff\x10"},
+		// Surrounding whitespace is ignored.
+		{`{"image":" AP8Q\n"}`, "\x00\xff\x10"},
+	})
+	for _, payload := range []string{`{"image":"not base64!"}`, `{"image":"AP8"}`} {
+		if got, err := remap.remapPayload(remap.From, nil, payload); err == nil {
+			t.Errorf("remapping %q: got %q, want an error", payload, got)
+		}
+	}
+}
+
+func TestBase64Disabled(t *testing.T) {
+	var remap Remap
+	if got := remap.encodeBase64("AP8Q"); got != "AP8Q" {
+		t.Errorf("encoding with base64_encode unset: got %q", got)
+	}
+	if got, err := remap.decodeBase64("AP8Q"); err != nil || got != "AP8Q" {
+		t.Errorf("decoding with base64_decode unset: got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Batch is a named group collecting the messages of the remaps referencing it
+// into a single JSON object, keyed by each remap's batch_key, which is
+// published to To every Interval (default 1s) and on shutdown.
+type Batch struct {
+	Name     string        `toml:"name"`
+	To       string        `toml:"to"`
+	Interval time.Duration `toml:"interval"`
+	PubQoS   byte          `toml:"pub_qos"`
+	Retained bool          `toml:"retained"`
+
+	batcher *batcher
+}
+
+type batcher struct {
+	mu     sync.Mutex
+	values map[string]any
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// validate returns every problem found in the batch.
+func (b Batch) validate() error {
+	var errs []error
+	if b.Name == "" {
+		errs = append(errs, fmt.Errorf("batch to %s: missing name", b.To))
+	}
+	if b.To == "" {
+		errs = append(errs, fmt.Errorf("batch %s: missing to", b.Name))
+	}
+	if b.Interval < 0 {
+		errs = append(errs, fmt.Errorf("batch %s: invalid interval %s (must be positive)", b.Name, b.Interval))
+	}
+	if b.PubQoS > 2 {
+		errs = append(errs, fmt.Errorf("batch %s: invalid pub_qos %d (must be 0, 1 or 2)", b.Name, b.PubQoS))
+	}
+	return errors.Join(errs...)
+}
+
+func (b *Batch) compile() {
+	if b.Interval == 0 {
+		b.Interval = time.Second
+	}
+	b.batcher = &batcher{values: make(map[string]any)}
+}
+
+// add stores payload under key, replacing the previous value of key since the
+// last flush. JSON payloads are stored decoded so they are nested in the
+// batch instead of quoted.
+func (b *batcher) add(key string, payload string) {
+	var value any = payload
+	if decoded, err := decodeJSON(payload); err == nil {
+		value = decoded
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.values[key] = value
+}
+
+// take returns the collected values and starts a new batch, or nil if nothing
+// was collected.
+func (b *batcher) take() map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.values) == 0 {
+		return nil
+	}
+	values := b.values
+	b.values = make(map[string]any)
+	return values
+}
+
+// start publishes the batch on every interval until stop is called.
+func (b Batch) start(publish func(outgoingMessage)) {
+	b.batcher.stop = make(chan struct{})
+	b.batcher.done = make(chan struct{})
+	go func() {
+		defer close(b.batcher.done)
+		ticker := time.NewTicker(b.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.flush(publish)
+			case <-b.batcher.stop:
+				b.flush(publish)
+				return
+			}
+		}
+	}()
+}
+
+// stop stops publishing the batch, publishing what was collected so far.
+func (b Batch) stop() {
+	close(b.batcher.stop)
+	<-b.batcher.done
+}
+
+func (b Batch) flush(publish func(outgoingMessage)) {
+	values := b.batcher.take()
+	if values == nil {
+		return
+	}
+	payload, err := encodeJSON(values)
+	if err != nil {
+		slog.Error("Error encoding batch", "batch", b.Name, "error", err)
+		return
+	}
+	slog.Debug("Publishing batch", "batch", b.Name, "to", b.To, "values", len(values))
+	publish(outgoingMessage{topic: b.To, qos: b.PubQoS, retained: b.Retained, payload: payload})
+}
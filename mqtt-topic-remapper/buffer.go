@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type outgoingMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  string
+	// deadLetterTopic receives the message if it can't be published, when
+	// publish_dead_letter is set.
+	deadLetterTopic string
+	// expiresAt is when the message is dropped if it hasn't been published
+	// yet, the zero time for never.
+	expiresAt time.Time
+	// source and receivedAt are the topic and time the message was received
+	// on for remapped messages, for the processing duration and dropped
+	// messages metrics.
+	source     string
+	receivedAt time.Time
+	// log is the logger of the remap the message was published by, if any.
+	log *slog.Logger
+	// forgetEcho is called when the message isn't published after all, so
+	// that the echo filter expecting it back doesn't ignore the next message
+	// with the same payload instead.
+	forgetEcho func()
+}
+
+// logger returns the logger of the log entries about msg.
+func (msg outgoingMessage) logger() *slog.Logger {
+	if msg.log == nil {
+		return slog.Default()
+	}
+	return msg.log
+}
+
+// expired reports whether msg expired before it could be published, logging
+// and counting it if so.
+func (msg outgoingMessage) expired() bool {
+	if msg.expiresAt.IsZero() || time.Now().Before(msg.expiresAt) {
+		return false
+	}
+	msg.logger().Warn("Dropping expired message", "topic", msg.topic, "expired_at", msg.expiresAt)
+	messagesExpired.WithLabelValues(msg.topic).Inc()
+	msg.dropped(dropExpired)
+	return true
+}
+
+// dropped counts msg as dropped for reason and forgets its echo.
+func (msg outgoingMessage) dropped(reason string) {
+	countDropped(msg.source, reason)
+	msg.notPublished()
+}
+
+// notPublished forgets the echo of msg, which won't be published.
+func (msg outgoingMessage) notPublished() {
+	if msg.forgetEcho != nil {
+		msg.forgetEcho()
+	}
+}
+
+const (
+	queueFullBlock      = "block"
+	queueFullDropOldest = "drop_oldest"
+)
+
+// offlineBuffer holds the messages remapped while the client is disconnected
+// from the broker and publishes them, in order, once it reconnects. When the
+// buffer is full the oldest message is dropped.
+type offlineBuffer struct {
+	mu        sync.Mutex
+	size      int
+	connected bool
+	messages  []outgoingMessage
+	dropped   int
+	// timeout bounds the wait for the acknowledgement of QoS 1 and 2
+	// publishes, which are retried up to retries times on failure with an
+	// exponential backoff starting at retryInterval.
+	timeout       time.Duration
+	retries       int
+	retryInterval time.Duration
+	deadLetter    bool
+	// closed is set, and closing closed, once shutdown starts, after which no
+	// new publishes are accepted so inFlight can be waited on.
+	closed   bool
+	closing  chan struct{}
+	inFlight sync.WaitGroup
+	// queue holds the messages passed to publishAsync until one of the
+	// workers publishes them.
+	queue      chan queuedMessage
+	dropOldest bool
+	// dryRun logs the messages instead of publishing them.
+	dryRun bool
+	// lastValues are republished on connect, after the buffered messages.
+	lastValues *lastValues
+}
+
+type queuedMessage struct {
+	client mqtt.Client
+	msg    outgoingMessage
+}
+
+func newOfflineBuffer(config Config, dryRun bool) *offlineBuffer {
+	b := &offlineBuffer{
+		size:          config.BufferSize,
+		timeout:       config.PublishTimeout,
+		retries:       config.PublishRetries,
+		retryInterval: config.PublishRetryInterval,
+		deadLetter:    config.PublishDeadLetter,
+		closing:       make(chan struct{}),
+		queue:         make(chan queuedMessage, config.QueueSize),
+		dropOldest:    config.QueueFull == queueFullDropOldest,
+		dryRun:        dryRun,
+		lastValues:    newLastValues(config.RepublishCacheSize),
+	}
+	for i := 0; i < config.MaxInFlight; i++ {
+		go b.work()
+	}
+	return b
+}
+
+// work publishes the queued messages. The workers live as long as the
+// process, idle once the buffer is drained.
+func (b *offlineBuffer) work() {
+	for queued := range b.queue {
+		b.publish(queued.client, queued.msg)
+		b.inFlight.Done()
+	}
+}
+
+// publish publishes msg, or buffers it if the client is disconnected.
+func (b *offlineBuffer) publish(client mqtt.Client, msg outgoingMessage) {
+	if msg.expired() || b.enqueueIfDisconnected(msg) {
+		return
+	}
+	err := publish(client, msg, b.timeout)
+	interval := b.retryInterval
+	for attempt := 1; attempt <= b.retries && err != nil && !errors.Is(err, mqtt.ErrNotConnected); attempt++ {
+		msg.logger().Warn("Retrying failed publish", "topic", msg.topic, "attempt", attempt, "retry_in", interval, "error", err)
+		select {
+		case <-time.After(interval):
+		case <-b.closing:
+			// Waiting would only hold up the drain, which gives up on the
+			// message anyway once its timeout expires.
+			msg.logger().Warn("Abandoning publish retries on shutdown", "topic", msg.topic, "error", err)
+			msg.dropped(dropShutdown)
+			return
+		}
+		interval *= 2
+		if msg.expired() {
+			return
+		}
+		err = publish(client, msg, b.timeout)
+	}
+	if errors.Is(err, mqtt.ErrNotConnected) && b.size > 0 {
+		b.enqueue(msg)
+		return
+	}
+	if err != nil {
+		msg.logger().Error("Error publishing message", "topic", msg.topic, "attempts", b.retries+1, "error", err)
+		msg.dropped(dropPublishError)
+		if b.deadLetter && msg.deadLetterTopic != "" {
+			if err := publish(client, newPublishDeadLetter(msg, err), b.timeout); err != nil {
+				msg.logger().Error("Error publishing dead letter", "topic", msg.deadLetterTopic, "error", err)
+			}
+		}
+	}
+}
+
+// publishAsync queues msg to be published in the background, tracking it so
+// drain can wait for it. When the queue is full it blocks until there is room,
+// or drops the oldest queued message with queue_full "drop_oldest". Messages
+// are dropped once the buffer is draining.
+func (b *offlineBuffer) publishAsync(client mqtt.Client, msg outgoingMessage) {
+	if b.dryRun {
+		msg.logger().Info("Dry run, not publishing message", "topic", msg.topic, "payload", msg.payload)
+		msg.notPublished()
+		return
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		msg.logger().Debug("Dropping message published while shutting down", "topic", msg.topic)
+		msg.dropped(dropShutdown)
+		return
+	}
+	b.inFlight.Add(1)
+	b.mu.Unlock()
+
+	queued := queuedMessage{client: client, msg: msg}
+	if !b.dropOldest {
+		b.queue <- queued
+		return
+	}
+	for {
+		select {
+		case b.queue <- queued:
+			return
+		default:
+		}
+		select {
+		case oldest := <-b.queue:
+			oldest.msg.logger().Debug("Publish queue is full, dropping oldest message", "topic", oldest.msg.topic)
+			oldest.msg.dropped(dropQueueFull)
+			b.inFlight.Done()
+		default:
+		}
+	}
+}
+
+// drain stops accepting new messages and waits up to timeout for the in-flight
+// publishes to complete, reporting whether they all did.
+func (b *offlineBuffer) drain(timeout time.Duration) bool {
+	b.mu.Lock()
+	b.closed = true
+	close(b.closing)
+	if len(b.messages) > 0 {
+		slog.Warn("Discarding offline buffer on shutdown", "messages", len(b.messages))
+		for _, msg := range b.messages {
+			msg.dropped(dropShutdown)
+		}
+	}
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (b *offlineBuffer) enqueueIfDisconnected(msg outgoingMessage) bool {
+	if b.size == 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.connected {
+		return false
+	}
+	b.push(msg)
+	return true
+}
+
+func (b *offlineBuffer) enqueue(msg outgoingMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.push(msg)
+}
+
+func (b *offlineBuffer) push(msg outgoingMessage) {
+	if len(b.messages) >= b.size {
+		b.messages[0].dropped(dropBufferFull)
+		b.messages = b.messages[1:]
+		b.dropped++
+	}
+	b.messages = append(b.messages, msg)
+}
+
+// onConnectionLost must be called when the connection to the broker is lost.
+func (b *offlineBuffer) onConnectionLost() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connected = false
+}
+
+// onConnect must be called when the client (re)connects. It flushes the
+// buffered messages; the buffer keeps accepting new messages until it is
+// empty so they are published in order. The last values are republished
+// after them.
+func (b *offlineBuffer) onConnect(client mqtt.Client) {
+	b.mu.Lock()
+	if len(b.messages) > 0 || b.dropped > 0 {
+		slog.Info("Flushing offline buffer", "messages", len(b.messages), "dropped", b.dropped)
+	}
+	b.dropped = 0
+	b.mu.Unlock()
+
+	for {
+		b.mu.Lock()
+		if len(b.messages) == 0 {
+			b.connected = true
+			b.mu.Unlock()
+			b.lastValues.republish(client, b)
+			return
+		}
+		msg := b.messages[0]
+		b.messages = b.messages[1:]
+		b.mu.Unlock()
+
+		if msg.expired() {
+			continue
+		}
+		if err := publish(client, msg, b.timeout); err != nil {
+			msg.logger().Error("Error publishing buffered message", "topic", msg.topic, "error", err)
+			if errors.Is(err, mqtt.ErrNotConnected) {
+				b.mu.Lock()
+				b.messages = append([]outgoingMessage{msg}, b.messages...)
+				b.mu.Unlock()
+				return
+			}
+			msg.dropped(dropPublishError)
+		}
+	}
+}
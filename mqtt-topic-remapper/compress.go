@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// compressionGzip is the only compression supported by decompress and
+// compress.
+const compressionGzip = "gzip"
+
+// decompress inflates the incoming payload with decompress set, before it is
+// transformed. With max_payload_size the decompressed payload is limited to
+// it too, so that small compressed payloads can't inflate without bound.
+func (r Remap) decompress(payload string) (string, error) {
+	if r.Decompress == "" {
+		return payload, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader([]byte(payload)))
+	if err != nil {
+		return "", fmt.Errorf("payload is not valid gzip: %s", err)
+	}
+	var limited io.Reader = reader
+	if r.maxPayloadSize > 0 {
+		limited = io.LimitReader(reader, int64(r.maxPayloadSize)+1)
+	}
+	decompressed, err := io.ReadAll(limited)
+	if err != nil {
+		return "", fmt.Errorf("payload is not valid gzip: %s", err)
+	}
+	if r.maxPayloadSize > 0 && len(decompressed) > r.maxPayloadSize {
+		return "", fmt.Errorf("decompressed payload is larger than max_payload_size %d", r.maxPayloadSize)
+	}
+	return string(decompressed), nil
+}
+
+// compress compresses the published payload with compress set.
+func (r Remap) compress(payload string) string {
+	if r.Compress == "" {
+		return payload
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	// Writing to a bytes.Buffer can't fail.
+	_, _ = writer.Write([]byte(payload))
+	_ = writer.Close()
+	return compressed.String()
+}
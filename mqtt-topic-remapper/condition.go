@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// errConditionNotMet is returned by remap when the payload doesn't meet the
+// remap condition. It wraps errFiltered.
+var errConditionNotMet = fmt.Errorf("%w: condition not met", errFiltered)
+
+// conditionOperators are tried in order, so two character operators are found
+// before their one character prefixes.
+var conditionOperators = []string{"=~", "==", "!=", "<=", ">=", "<", ">"}
+
+// condition is a parsed remap condition of the form "<operand> <operator>
+// <value>", e.g. "battery < 20" or `state == "ON"`. The operand is a dotted
+// JSON path into the payload or "value" for the whole payload. The value is a
+// number, a quoted or bare string, or a regular expression for "=~".
+type condition struct {
+	path     string
+	operator string
+	value    string
+	number   *float64
+	regex    *regexp.Regexp
+}
+
+func parseCondition(expr string) (*condition, error) {
+	index, operator := -1, ""
+	for _, op := range conditionOperators {
+		if i := strings.Index(expr, op); i >= 0 && (index < 0 || i < index) {
+			index, operator = i, op
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("missing operator (one of %s)", strings.Join(conditionOperators, " "))
+	}
+
+	c := &condition{
+		path:     strings.TrimSpace(expr[:index]),
+		operator: operator,
+		value:    strings.TrimSpace(expr[index+len(operator):]),
+	}
+	if c.path == "" {
+		return nil, fmt.Errorf("missing operand before %s", operator)
+	}
+	if unquoted, err := strconv.Unquote(c.value); err == nil {
+		c.value = unquoted
+	} else if number, err := strconv.ParseFloat(c.value, 64); err == nil {
+		c.number = &number
+	}
+
+	switch operator {
+	case "=~":
+		regex, err := regexp.Compile(c.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %s: %s", c.value, err)
+		}
+		c.regex = regex
+	case "<", "<=", ">", ">=":
+		if c.number == nil {
+			return nil, fmt.Errorf("%s needs a number, got %s", operator, c.value)
+		}
+	}
+	return c, nil
+}
+
+// met reports whether payload meets the condition. Payloads missing the field
+// or, for numeric comparisons, that aren't numbers never meet it.
+func (c *condition) met(payload string) bool {
+	value := strings.TrimSpace(payload)
+	if c.path != "value" {
+		field, err := extractJSONField(payload, c.path)
+		if err != nil {
+			return false
+		}
+		value = field
+	}
+
+	if c.regex != nil {
+		return c.regex.MatchString(value)
+	}
+	if c.number != nil {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return c.operator == "!="
+		}
+		switch c.operator {
+		case "==":
+			return number == *c.number
+		case "!=":
+			return number != *c.number
+		case "<":
+			return number < *c.number
+		case "<=":
+			return number <= *c.number
+		case ">":
+			return number > *c.number
+		default:
+			return number >= *c.number
+		}
+	}
+	if c.operator == "!=" {
+		return value != c.value
+	}
+	return value == c.value
+}
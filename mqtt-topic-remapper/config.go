@@ -0,0 +1,434 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+type Config struct {
+	// Version is the schema version of the config file, 1 when unset. See
+	// currentConfigVersion for what changed, -migrate converts older
+	// configs.
+	Version int `toml:"version"`
+	// BufferSize is the maximum number of remapped messages kept in memory
+	// while disconnected from the broker, 0 disables buffering.
+	BufferSize int `toml:"buffer_size"`
+	// ConnectInitialInterval, ConnectMaxInterval and ConnectMaxElapsedTime
+	// control the exponential backoff used when connecting to the broker. The
+	// max interval also caps the delay between automatic reconnects.
+	ConnectInitialInterval time.Duration `toml:"connect_initial_interval"`
+	ConnectMaxInterval     time.Duration `toml:"connect_max_interval"`
+	ConnectMaxElapsedTime  time.Duration `toml:"connect_max_elapsed_time"`
+	// ConnectRetries is the number of times connecting on startup is retried
+	// before giving up, overridden by the MQTT_CONNECT_RETRIES env var (default
+	// -1, retry forever unless ConnectMaxElapsedTime is exceeded).
+	ConnectRetries *int `toml:"connect_retries"`
+	// ConnectTimeout bounds each connection attempt and KeepAlive is the
+	// interval between pings sent to the broker.
+	ConnectTimeout time.Duration `toml:"connect_timeout"`
+	KeepAlive      time.Duration `toml:"keep_alive"`
+	// Source is the broker the remaps subscribe to (see Config.sourceBroker)
+	// and Destination, if set, the broker the remapped messages are published
+	// to, bridging the two. Without it both sides use the source broker.
+	Source      *Broker `toml:"source"`
+	Destination *Broker `toml:"destination"`
+	// ProtocolVersion is the MQTT protocol version used to connect: 4 for
+	// MQTT 3.1.1 (default) or 3 for MQTT 3.1. MQTT 5 isn't supported by the
+	// client library (paho.mqtt.golang), so 5 is rejected.
+	ProtocolVersion uint `toml:"protocol_version"`
+	// PublishTimeout is how long to wait for the broker to acknowledge a QoS 1
+	// or 2 publish or a subscription, and PublishRetries how many times a failed publish is
+	// retried, waiting PublishRetryInterval before the first retry and twice
+	// as long before each of the next. With PublishDeadLetter the remapped
+	// messages still failing after the retries are published to the dead
+	// letter topic of their remap.
+	PublishTimeout       time.Duration `toml:"publish_timeout"`
+	PublishRetries       int           `toml:"publish_retries"`
+	PublishRetryInterval time.Duration `toml:"publish_retry_interval"`
+	PublishDeadLetter    bool          `toml:"publish_dead_letter"`
+	// MaxInFlight is the number of messages published concurrently and
+	// QueueSize the number of remapped messages waiting to be published. When
+	// the queue is full QueueFull decides whether the oldest queued message is
+	// dropped ("drop_oldest", default) or receiving messages blocks until there
+	// is room ("block"). The client stops reading acknowledgements while
+	// receiving blocks, so "block" is only suited to publishing at QoS 0 or to
+	// a destination broker, QoS 1 and 2 publishes to the source broker would
+	// wait for their publish_timeout.
+	MaxInFlight int    `toml:"max_inflight"`
+	QueueSize   int    `toml:"queue_size"`
+	QueueFull   string `toml:"queue_full"`
+	// DelayShutdown decides what happens on shutdown to the messages of
+	// remaps with a delay that are still waiting: "flush" (default) publishes
+	// them right away and "drop" discards them.
+	DelayShutdown string `toml:"delay_shutdown"`
+	// DrainTimeout is how long to wait on shutdown for the in-flight publishes
+	// to complete before disconnecting.
+	DrainTimeout time.Duration `toml:"drain_timeout"`
+	// ClientID is the MQTT client ID, overridden by the MQTT_CLIENT_ID env var.
+	// When empty a unique ID is generated on each start, so set it if a
+	// persistent session must be resumed across restarts.
+	ClientID string `toml:"client_id"`
+	// CleanSession (default true) starts a new session on every connection.
+	// Set it to false to resume a persistent session, so the broker queues QoS
+	// 1 and 2 messages while the remapper is offline. That requires a stable
+	// ClientID.
+	CleanSession *bool `toml:"clean_session"`
+	// WillTopic, WillPayload, WillQoS and WillRetained configure the message
+	// the broker publishes if the remapper disconnects unexpectedly. The same
+	// message is published on a clean shutdown.
+	WillTopic    string `toml:"will_topic"`
+	WillPayload  string `toml:"will_payload"`
+	WillQoS      byte   `toml:"will_qos"`
+	WillRetained bool   `toml:"will_retained"`
+	// StatusTopic receives the retained StatusOnline (default "online")
+	// whenever the remapper connects and StatusOffline (default "offline")
+	// on shutdown, the latter also set as will so that it is published if the
+	// remapper dies. It replaces WillTopic, which can't be set with it.
+	StatusTopic   string `toml:"status_topic"`
+	StatusOnline  string `toml:"status_online"`
+	StatusOffline string `toml:"status_offline"`
+	// Mappings are named value mapping sets that remaps can reference with
+	// use instead of repeating the same message mappings.
+	Mappings map[string]map[string]string `toml:"mappings"`
+	// MaxPayloadSize drops the incoming messages larger than this number of
+	// bytes, unless the remap sets its own limit (0 for no limit).
+	MaxPayloadSize int `toml:"max_payload_size"`
+	// DiscoveryPrefix is the topic prefix of the Home Assistant discovery
+	// messages of the remaps with a discovery (default "homeassistant").
+	DiscoveryPrefix string `toml:"discovery_prefix"`
+	// RepublishCacheSize is the maximum number of topics whose last message
+	// is kept for the remaps with republish_on_connect (default 1000), the
+	// least recently published ones are forgotten first. RepublishCacheFile,
+	// if set, is where they are saved on shutdown and loaded from on startup,
+	// so that they are republished after a restart too.
+	RepublishCacheSize int    `toml:"republish_cache_size"`
+	RepublishCacheFile string `toml:"republish_cache_file"`
+	// DeadLetterTopic receives the messages that fail to be remapped, unless
+	// the remap sets its own.
+	DeadLetterTopic string  `toml:"dead_letter_topic"`
+	Batches         []Batch `toml:"batch"`
+	Merges          []Merge `toml:"merge"`
+	Remaps          []Remap `toml:"remap"`
+
+	// disabledRemaps is the number of remaps with enabled = false, which
+	// loadConfig leaves out of Remaps.
+	disabledRemaps int
+}
+
+// loadConfig loads, validates and compiles the config files at paths, which
+// can be written in TOML, YAML (.yaml or .yml) or JSON (.json) depending on
+// their extension. Directories are loaded as every config file they contain,
+// see configFiles and decodeConfigFiles for how the files are combined.
+func loadConfig(paths []string) (Config, error) {
+	var config Config
+	files, err := configFiles(paths)
+	if err != nil {
+		return config, err
+	}
+	if err := decodeConfigFiles(files, &config); err != nil {
+		return config, err
+	}
+
+	errs := config.resolveMappings()
+	errs = append(errs, config.expandEnv()...)
+	errs = append(errs, config.overrideFromEnv()...)
+	config.setDefaults()
+	errs = append(errs, config.validate()...)
+
+	for i := range config.Remaps {
+		if !config.Remaps[i].Bidirectional {
+			continue
+		}
+		reverse, err := config.Remaps[i].reverse()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// Each remap publishes to the topic the other subscribes to. With a
+		// destination broker they are published where they aren't received.
+		if config.Destination == nil {
+			echoes := newEchoFilter()
+			config.Remaps[i].echoes, config.Remaps[i].reverseEchoes = echoes, true
+			reverse.echoes, reverse.reverseEchoes = echoes, true
+		}
+		config.Remaps = append(config.Remaps, reverse)
+	}
+
+	batches := make(map[string]*batcher, len(config.Batches))
+	for i := range config.Batches {
+		if err := config.Batches[i].validate(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, ok := batches[config.Batches[i].Name]; ok {
+			errs = append(errs, fmt.Errorf("batch %s: duplicate name", config.Batches[i].Name))
+		}
+		config.Batches[i].compile()
+		batches[config.Batches[i].Name] = config.Batches[i].batcher
+	}
+
+	merges := make(map[string]*merger, len(config.Merges))
+	for i := range config.Merges {
+		if err := config.Merges[i].validate(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, ok := merges[config.Merges[i].Name]; ok {
+			errs = append(errs, fmt.Errorf("merge %s: duplicate name", config.Merges[i].Name))
+		}
+		config.Merges[i].compile()
+		merges[config.Merges[i].Name] = config.Merges[i].merger
+	}
+
+	// froms holds the file of the enabled remap handling each topic.
+	froms := make(map[string]string, len(config.Remaps))
+	for i := range config.Remaps {
+		if err := config.Remaps[i].validate(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := config.Remaps[i].compile(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// A disabled remap can stand in for an enabled one with the same from.
+		if config.Remaps[i].enabled() {
+			if file, ok := froms[config.Remaps[i].From]; ok {
+				if file != config.Remaps[i].file {
+					errs = append(errs, fmt.Errorf("remap from %s: duplicate from in %s and %s, only one remap can handle a topic", config.Remaps[i].From, file, config.Remaps[i].file))
+				} else {
+					errs = append(errs, fmt.Errorf("remap from %s: duplicate from, only one remap can handle a topic", config.Remaps[i].From))
+				}
+			}
+			froms[config.Remaps[i].From] = config.Remaps[i].file
+		}
+		if name := config.Remaps[i].Batch; name != "" {
+			if config.Remaps[i].batcher = batches[name]; config.Remaps[i].batcher == nil {
+				errs = append(errs, fmt.Errorf("remap from %s: unknown batch %s", config.Remaps[i].From, name))
+			}
+		}
+		if name := config.Remaps[i].Merge; name != "" {
+			if config.Remaps[i].merger = merges[name]; config.Remaps[i].merger == nil {
+				errs = append(errs, fmt.Errorf("remap from %s: unknown merge %s", config.Remaps[i].From, name))
+			}
+		}
+		config.Remaps[i].deadLetterTopic = config.Remaps[i].DeadLetterTopic
+		if config.Remaps[i].deadLetterTopic == "" {
+			config.Remaps[i].deadLetterTopic = config.DeadLetterTopic
+		}
+		config.Remaps[i].maxPayloadSize = config.Remaps[i].MaxPayloadSize
+		if config.Remaps[i].maxPayloadSize == 0 {
+			config.Remaps[i].maxPayloadSize = config.MaxPayloadSize
+		}
+	}
+	enabled := config.Remaps[:0]
+	for _, remap := range config.Remaps {
+		if remap.enabled() {
+			enabled = append(enabled, remap)
+		} else {
+			config.disabledRemaps++
+		}
+	}
+	config.Remaps = enabled
+	// The messages published to a destination broker aren't received back.
+	if config.Destination == nil {
+		errs = append(errs, checkLoops(config.Remaps)...)
+	}
+
+	return config, errors.Join(errs...)
+}
+
+// overrideFromEnv overrides the settings that can also be set by an env var.
+func (c *Config) overrideFromEnv() []error {
+	var errs []error
+	if value := os.Getenv("MQTT_CONNECT_RETRIES"); value != "" {
+		retries, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid MQTT_CONNECT_RETRIES %s (must be an integer)", value))
+		} else {
+			c.ConnectRetries = &retries
+		}
+	}
+	return errs
+}
+
+func (c *Config) setDefaults() {
+	if c.ConnectInitialInterval == 0 {
+		c.ConnectInitialInterval = time.Second
+	}
+	if c.ConnectMaxInterval == 0 {
+		c.ConnectMaxInterval = time.Minute
+	}
+	if c.ConnectRetries == nil {
+		retries := -1
+		c.ConnectRetries = &retries
+	}
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = 30 * time.Second
+	}
+	if c.KeepAlive == 0 {
+		c.KeepAlive = 30 * time.Second
+	}
+	if c.ProtocolVersion == 0 {
+		c.ProtocolVersion = 4
+	}
+	if c.PublishTimeout == 0 {
+		c.PublishTimeout = 10 * time.Second
+	}
+	if c.PublishRetryInterval == 0 {
+		c.PublishRetryInterval = time.Second
+	}
+	if c.MaxInFlight == 0 {
+		c.MaxInFlight = 64
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = 10000
+	}
+	if c.QueueFull == "" {
+		c.QueueFull = queueFullDropOldest
+	}
+	if c.DelayShutdown == "" {
+		c.DelayShutdown = delayShutdownFlush
+	}
+	if c.DrainTimeout == 0 {
+		c.DrainTimeout = 5 * time.Second
+	}
+	if c.StatusOnline == "" {
+		c.StatusOnline = "online"
+	}
+	if c.StatusOffline == "" {
+		c.StatusOffline = "offline"
+	}
+	if c.DiscoveryPrefix == "" {
+		c.DiscoveryPrefix = "homeassistant"
+	}
+	if c.RepublishCacheSize == 0 {
+		c.RepublishCacheSize = 1000
+	}
+}
+
+// validate returns every problem found in the global settings.
+func (c Config) validate() []error {
+	var errs []error
+	if c.MaxPayloadSize < 0 {
+		errs = append(errs, fmt.Errorf("invalid max_payload_size %d (must not be negative)", c.MaxPayloadSize))
+	}
+	if c.BufferSize < 0 {
+		errs = append(errs, fmt.Errorf("invalid buffer_size %d (must not be negative)", c.BufferSize))
+	}
+	if c.RepublishCacheSize < 0 {
+		errs = append(errs, fmt.Errorf("invalid republish_cache_size %d (must be positive)", c.RepublishCacheSize))
+	}
+	if c.ConnectTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid connect_timeout %s (must be positive)", c.ConnectTimeout))
+	}
+	if c.ProtocolVersion == 5 {
+		errs = append(errs, fmt.Errorf("invalid protocol_version 5, MQTT 5 isn't supported by the MQTT client library (use 3 or 4)"))
+	} else if c.ProtocolVersion != 3 && c.ProtocolVersion != 4 {
+		errs = append(errs, fmt.Errorf("invalid protocol_version %d (must be 3 for MQTT 3.1 or 4 for MQTT 3.1.1)", c.ProtocolVersion))
+	}
+	if c.PublishTimeout < 0 || c.PublishRetries < 0 || c.PublishRetryInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid publish_timeout %s, publish_retries %d or publish_retry_interval %s (must not be negative)", c.PublishTimeout, c.PublishRetries, c.PublishRetryInterval))
+	}
+	if c.MaxInFlight < 0 || c.QueueSize < 0 {
+		errs = append(errs, fmt.Errorf("invalid max_inflight %d or queue_size %d (must be positive)", c.MaxInFlight, c.QueueSize))
+	}
+	if c.QueueFull != queueFullBlock && c.QueueFull != queueFullDropOldest {
+		errs = append(errs, fmt.Errorf("invalid queue_full %q (must be %q or %q)", c.QueueFull, queueFullBlock, queueFullDropOldest))
+	}
+	if c.DelayShutdown != delayShutdownFlush && c.DelayShutdown != delayShutdownDrop {
+		errs = append(errs, fmt.Errorf("invalid delay_shutdown %q (must be %q or %q)", c.DelayShutdown, delayShutdownFlush, delayShutdownDrop))
+	}
+	if c.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid drain_timeout %s (must be positive)", c.DrainTimeout))
+	}
+	if c.KeepAlive < time.Second {
+		errs = append(errs, fmt.Errorf("invalid keep_alive %s (must be at least 1s)", c.KeepAlive))
+	}
+	if *c.ConnectRetries < -1 {
+		errs = append(errs, fmt.Errorf("invalid connect_retries %d (must be at least 0, or -1 to retry forever)", *c.ConnectRetries))
+	}
+	if c.ConnectInitialInterval < 0 || c.ConnectMaxInterval < c.ConnectInitialInterval || c.ConnectMaxElapsedTime < 0 {
+		errs = append(errs, fmt.Errorf("invalid connect backoff: initial interval %s, max interval %s, max elapsed time %s", c.ConnectInitialInterval, c.ConnectMaxInterval, c.ConnectMaxElapsedTime))
+	}
+	if c.Source != nil {
+		errs = append(errs, c.Source.validate("source")...)
+	}
+	if c.Destination != nil {
+		errs = append(errs, c.Destination.validate("destination")...)
+	}
+	if c.WillQoS > 2 {
+		errs = append(errs, fmt.Errorf("invalid will_qos %d (must be 0, 1 or 2)", c.WillQoS))
+	}
+	if c.WillTopic == "" && c.WillPayload != "" {
+		errs = append(errs, fmt.Errorf("will_payload is set but will_topic is empty"))
+	}
+	if c.StatusTopic != "" && c.WillTopic != "" {
+		errs = append(errs, fmt.Errorf("status_topic and will_topic can't be used together, the status offline payload is the will"))
+	}
+	return errs
+}
+
+// dumpConfig writes the config as TOML, as it was loaded with the defaults
+// applied and the environment variables expanded, each active remap
+// (including the reverse of bidirectional ones) preceded by a comment. Remap
+// options left at their zero value are omitted to keep it readable, see
+// setFields.
+func dumpConfig(w io.Writer, file string, config Config) error {
+	remaps := config.Remaps
+	config.Remaps = nil
+	fmt.Fprintf(w, "# Effective config loaded from %s\n", file)
+	if err := toml.NewEncoder(w).Encode(config); err != nil {
+		return err
+	}
+	for i, remap := range remaps {
+		var encoded strings.Builder
+		if err := toml.NewEncoder(&encoded).Encode(map[string][]any{"remap": {setFields(remap)}}); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "\n# Active remap %d of %d, from %s\n", i+1, len(remaps), remap.From)
+		io.WriteString(w, encoded.String())
+	}
+	return nil
+}
+
+// setFields returns a copy of the struct value with only its exported fields
+// that aren't left at their zero value, in the same order. Pointer fields are
+// kept whatever they point to, since an option set to its zero value (e.g.
+// decimals = 0 or default = "") isn't the same as leaving it unset, and the
+// encoder leaves out the nil ones.
+func setFields(value any) any {
+	original := reflect.ValueOf(value)
+	var fields []reflect.StructField
+	var values []reflect.Value
+	for i := 0; i < original.NumField(); i++ {
+		field := original.Type().Field(i)
+		if !field.IsExported() || (field.Type.Kind() != reflect.Pointer && original.Field(i).IsZero()) {
+			continue
+		}
+		fields = append(fields, field)
+		values = append(values, original.Field(i))
+	}
+	set := reflect.New(reflect.StructOf(fields)).Elem()
+	for i, value := range values {
+		set.Field(i).Set(value)
+	}
+	return set.Interface()
+}
+
+// logConfigErrors logs every problem contained in an error returned by
+// loadConfig.
+func logConfigErrors(file string, err error) {
+	for _, err := range flattenErrors(err) {
+		slog.Error("Error loading config file", "file", file, "error", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDumpConfigOmitsZeroOptions(t *testing.T) {
+	config, file := loadTestConfig(t, `
+[[remap]]
+from = "in"
+to = "out"
+scale = 2.0
+decimals = 0
+default = ""
+stale_after = "1m"
+stale_topic = "stale"
+stale_payload = ""
+base64_encode = true
+
+[[remap]]
+from = "rounded"
+to = "out"
+scale = 2.0
+round = 0
+`)
+	var dump strings.Builder
+	if err := dumpConfig(&dump, file, config); err != nil {
+		t.Fatal(err)
+	}
+	_, remaps, _ := strings.Cut(dump.String(), "[[remap]]")
+	for _, want := range []string{
+		`from = "in"`,
+		// Options set to their zero value through a pointer are kept.
+		"decimals = 0",
+		"round = 0",
+		`default = ""`,
+		`stale_payload = ""`,
+		"base64_encode = true",
+	} {
+		if !strings.Contains(remaps, "  "+want+"\n") {
+			t.Errorf("dumped remaps are missing %s:\n%s", want, remaps)
+		}
+	}
+	for _, unwanted := range []string{"retained", "base64_decode", "dedupe", "rate_limit", "delay", "offset"} {
+		if strings.Contains(remaps, "  "+unwanted+" ") {
+			t.Errorf("dumped remaps have %s left at its zero value:\n%s", unwanted, remaps)
+		}
+	}
+	// The dump is a valid config, loading back to the same remaps.
+	reloaded, _ := loadTestConfig(t, dump.String())
+	if len(reloaded.Remaps) != 2 || reloaded.Remaps[0].Decimals == nil || *reloaded.Remaps[0].Default != "" {
+		t.Errorf("reloading the dump got %+v", reloaded.Remaps)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// conversion converts a numeric payload value from one unit to another.
+type conversion func(float64) float64
+
+// conversions are the named unit conversions available to the convert option.
+// New conversions only need to be registered here.
+var conversions = map[string]conversion{
+	"c_to_f":     func(v float64) float64 { return v*9/5 + 32 },
+	"f_to_c":     func(v float64) float64 { return (v - 32) * 5 / 9 },
+	"c_to_k":     func(v float64) float64 { return v + 273.15 },
+	"k_to_c":     func(v float64) float64 { return v - 273.15 },
+	"wh_to_kwh":  func(v float64) float64 { return v / 1000 },
+	"kwh_to_wh":  func(v float64) float64 { return v * 1000 },
+	"pa_to_hpa":  func(v float64) float64 { return v / 100 },
+	"hpa_to_pa":  func(v float64) float64 { return v * 100 },
+	"ms_to_kmh":  func(v float64) float64 { return v * 3.6 },
+	"kmh_to_ms":  func(v float64) float64 { return v / 3.6 },
+	"mph_to_kmh": func(v float64) float64 { return v * 1.609344 },
+	"kmh_to_mph": func(v float64) float64 { return v / 1.609344 },
+	"in_to_mm":   func(v float64) float64 { return v * 25.4 },
+	"mm_to_in":   func(v float64) float64 { return v / 25.4 },
+}
+
+// convertNumber parses payload as a number and returns it converted.
+func convertNumber(payload string, convert conversion) (float64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(payload), 64)
+	if err != nil {
+		return 0, fmt.Errorf("payload %q is not a number", payload)
+	}
+	return convert(value), nil
+}
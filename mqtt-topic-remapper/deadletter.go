@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// deadLetter is the JSON payload published to the dead letter topic when a
+// message fails to be remapped.
+type deadLetter struct {
+	Topic     string    `json:"topic"`
+	Payload   string    `json:"payload"`
+	Error     string    `json:"error"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newDeadLetter(remap Remap, msg mqtt.Message, err error) outgoingMessage {
+	payload, _ := json.Marshal(deadLetter{
+		Topic:     msg.Topic(),
+		Payload:   string(msg.Payload()),
+		Error:     err.Error(),
+		Timestamp: time.Now(),
+	})
+	return outgoingMessage{
+		topic:   remap.deadLetterTopic,
+		qos:     remap.PubQoS,
+		payload: string(payload),
+		log:     remap.logger(),
+	}
+}
+
+// newPublishDeadLetter returns the dead letter of a remapped message that
+// couldn't be published.
+func newPublishDeadLetter(msg outgoingMessage, err error) outgoingMessage {
+	payload, _ := json.Marshal(deadLetter{
+		Topic:     msg.topic,
+		Payload:   msg.payload,
+		Error:     "publishing failed: " + err.Error(),
+		Timestamp: time.Now(),
+	})
+	return outgoingMessage{
+		topic:   msg.deadLetterTopic,
+		qos:     msg.qos,
+		payload: string(payload),
+		log:     msg.log,
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// debouncer defers publishing to each destination topic until no new message
+// has been remapped to it for delay, then publishes only the latest one. At
+// most maxTopicStates topics are pending, past that the least recently
+// scheduled one is published early.
+type debouncer struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	pending *topicStates[*debounced]
+}
+
+type debounced struct {
+	timer   *time.Timer
+	publish func()
+}
+
+func newDebouncer(delay time.Duration) *debouncer {
+	return &debouncer{delay: delay, pending: newTopicStates[*debounced](maxTopicStates)}
+}
+
+// schedule replaces the pending publish to topic, if any, with publish and
+// restarts the delay, reporting whether a pending publish was replaced.
+func (d *debouncer) schedule(topic string, publish func()) bool {
+	d.mu.Lock()
+	if pending, ok := d.pending.get(topic); ok && pending.timer.Stop() {
+		pending.publish = publish
+		pending.timer.Reset(d.delay)
+		d.mu.Unlock()
+		return true
+	}
+
+	pending := &debounced{publish: publish}
+	pending.timer = time.AfterFunc(d.delay, func() {
+		d.mu.Lock()
+		if current, ok := d.pending.get(topic); !ok || current != pending {
+			d.mu.Unlock()
+			return
+		}
+		d.pending.delete(topic)
+		publish := pending.publish
+		d.mu.Unlock()
+		publish()
+	})
+	evicted, ok := d.pending.set(topic, pending)
+	d.mu.Unlock()
+	if ok {
+		// A timer that already fired finds its entry gone and doesn't publish.
+		evicted.timer.Stop()
+		evicted.publish()
+	}
+	return false
+}
+
+// flush publishes every pending message right away, used on shutdown so the
+// last values aren't lost.
+func (d *debouncer) flush() {
+	d.mu.Lock()
+	var publishes []func()
+	for _, pending := range d.pending.all() {
+		// A timer that already fired finds its entry gone and doesn't publish.
+		pending.timer.Stop()
+		publishes = append(publishes, pending.publish)
+	}
+	d.pending = newTopicStates[*debounced](maxTopicStates)
+	d.mu.Unlock()
+
+	for _, publish := range publishes {
+		publish()
+	}
+}
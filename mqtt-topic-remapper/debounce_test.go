@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// publishes records the payloads published by a debouncer.
+type publishes struct {
+	mu       sync.Mutex
+	payloads []string
+}
+
+func (p *publishes) publish(payload string) func() {
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.payloads = append(p.payloads, payload)
+	}
+}
+
+func (p *publishes) get() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.payloads...)
+}
+
+func TestDebouncerPublishesLatest(t *testing.T) {
+	var published publishes
+	debouncer := newDebouncer(20 * time.Millisecond)
+	if debouncer.schedule("a", published.publish("1")) {
+		t.Error("the first publish replaced another one")
+	}
+	if !debouncer.schedule("a", published.publish("2")) {
+		t.Error("the second publish didn't replace the first one")
+	}
+	waitFor(t, "the debounced publish", func() bool { return len(published.get()) > 0 })
+	time.Sleep(40 * time.Millisecond)
+	if got := published.get(); len(got) != 1 || got[0] != "2" {
+		t.Errorf("published %q, want only 2", got)
+	}
+}
+
+func TestDebouncerFlush(t *testing.T) {
+	var published publishes
+	debouncer := newDebouncer(time.Hour)
+	debouncer.schedule("a", published.publish("a"))
+	debouncer.schedule("b", published.publish("b"))
+	debouncer.flush()
+	if got := published.get(); len(got) != 2 {
+		t.Errorf("flushed %q, want a and b", got)
+	}
+	debouncer.flush()
+	if got := published.get(); len(got) != 2 {
+		t.Errorf("flushing again published %q", got[2:])
+	}
+}
+
+func TestDebouncerPublishesEvictedEarly(t *testing.T) {
+	var published publishes
+	debouncer := newDebouncer(time.Hour)
+	debouncer.pending = newTopicStates[*debounced](2)
+	debouncer.schedule("a", published.publish("a"))
+	debouncer.schedule("b", published.publish("b"))
+	if got := published.get(); len(got) != 0 {
+		t.Fatalf("published %q before the delay", got)
+	}
+	debouncer.schedule("c", published.publish("c"))
+	if got := published.get(); len(got) != 1 || got[0] != "a" {
+		t.Errorf("published %q, want the oldest pending a", got)
+	}
+}
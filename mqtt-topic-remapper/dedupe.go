@@ -0,0 +1,40 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// deduplicator remembers the last payload published to each destination topic
+// so identical consecutive payloads can be suppressed. A payload is resent
+// anyway once maxAge (if not 0) has passed since it was last published. Only
+// the maxTopicStates most recently published topics are remembered.
+type deduplicator struct {
+	mu     sync.Mutex
+	maxAge time.Duration
+	last   *topicStates[publishedPayload]
+}
+
+type publishedPayload struct {
+	payload string
+	at      time.Time
+}
+
+func newDeduplicator(maxAge time.Duration) *deduplicator {
+	return &deduplicator{maxAge: maxAge, last: newTopicStates[publishedPayload](maxTopicStates)}
+}
+
+// duplicate reports whether payload is the same as the last one published to
+// topic, recording it as the last one otherwise.
+func (d *deduplicator) duplicate(topic string, payload string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	last, ok := d.last.get(topic)
+	if ok && last.payload == payload && (d.maxAge == 0 || now.Sub(last.at) < d.maxAge) {
+		return true
+	}
+	d.last.set(topic, publishedPayload{payload: payload, at: now})
+	return false
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	dedupe := newDeduplicator(0)
+	for _, test := range []struct {
+		topic     string
+		payload   string
+		duplicate bool
+	}{
+		{"a", "on", false},
+		{"a", "on", true},
+		{"b", "on", false},
+		{"a", "off", false},
+		{"a", "on", false},
+		{"a", "on", true},
+	} {
+		if got := dedupe.duplicate(test.topic, test.payload); got != test.duplicate {
+			t.Errorf("%q on %s: got duplicate %t, want %t", test.payload, test.topic, got, test.duplicate)
+		}
+	}
+}
+
+func TestDeduplicatorMaxAge(t *testing.T) {
+	dedupe := newDeduplicator(time.Millisecond)
+	dedupe.duplicate("a", "on")
+	time.Sleep(2 * time.Millisecond)
+	if dedupe.duplicate("a", "on") {
+		t.Error("suppressed a payload older than the max age")
+	}
+}
+
+func TestDeduplicatorIsBounded(t *testing.T) {
+	dedupe := newDeduplicator(0)
+	for i := 0; i < maxTopicStates+10; i++ {
+		dedupe.duplicate(string(rune(i)), "on")
+	}
+	if dedupe.last.len() != maxTopicStates {
+		t.Errorf("remembered %d topics, want %d", dedupe.last.len(), maxTopicStates)
+	}
+	// The oldest topic was forgotten, so its payload is published again.
+	if dedupe.duplicate(string(rune(0)), "on") {
+		t.Error("suppressed the payload of a forgotten topic")
+	}
+}
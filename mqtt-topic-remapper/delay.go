@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	delayShutdownFlush = "flush"
+	delayShutdownDrop  = "drop"
+)
+
+// maxDelayed is the number of messages a delayer holds at most, across all
+// its topics, so that a burst can't grow it without bound. The messages
+// delayed while it is full are dropped.
+const maxDelayed = 10000
+
+// delayer defers publishing by a fixed delay. The messages to each topic wait
+// in a queue served by a single timer, so they are published in the order
+// they were remapped.
+type delayer struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	queues  map[string]*delayQueue
+	pending int
+	// publishing is held while publishing, without mu so that scheduling
+	// never waits for a publish, to keep the publishes of the timers and of
+	// flush in order.
+	publishing sync.Mutex
+}
+
+type delayQueue struct {
+	timer   *time.Timer
+	pending []delayedPublish
+}
+
+type delayedPublish struct {
+	due     time.Time
+	publish func()
+}
+
+func newDelayer(delay time.Duration) *delayer {
+	return &delayer{delay: delay, queues: make(map[string]*delayQueue)}
+}
+
+// schedule calls publish once the delay has elapsed, after the publishes
+// scheduled to topic before it. It reports false, dropping publish, if the
+// delayer already holds maxDelayed messages.
+func (d *delayer) schedule(topic string, publish func()) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending >= maxDelayed {
+		return false
+	}
+	queue, ok := d.queues[topic]
+	if !ok {
+		queue = &delayQueue{}
+		queue.timer = time.AfterFunc(d.delay, func() { d.fire(topic, queue) })
+		d.queues[topic] = queue
+	}
+	queue.pending = append(queue.pending, delayedPublish{due: time.Now().Add(d.delay), publish: publish})
+	d.pending++
+	return true
+}
+
+// fire publishes the due messages of queue and rearms its timer for the next
+// one.
+func (d *delayer) fire(topic string, queue *delayQueue) {
+	d.publishing.Lock()
+	defer d.publishing.Unlock()
+
+	d.mu.Lock()
+	if d.queues[topic] != queue {
+		// Flushed or dropped while the timer was firing.
+		d.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	due := 0
+	for due < len(queue.pending) && !queue.pending[due].due.After(now) {
+		due++
+	}
+	publishes := queue.pending[:due]
+	queue.pending = queue.pending[due:]
+	d.pending -= due
+	d.mu.Unlock()
+
+	for _, pending := range publishes {
+		pending.publish()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.queues[topic] != queue {
+		return
+	}
+	if len(queue.pending) == 0 {
+		delete(d.queues, topic)
+		return
+	}
+	queue.timer.Reset(time.Until(queue.pending[0].due))
+}
+
+// flush publishes every pending message right away, in order, used on
+// shutdown with delay_shutdown "flush".
+func (d *delayer) flush() {
+	d.publishing.Lock()
+	defer d.publishing.Unlock()
+
+	d.mu.Lock()
+	var publishes []delayedPublish
+	for topic, queue := range d.queues {
+		queue.timer.Stop()
+		publishes = append(publishes, queue.pending...)
+		delete(d.queues, topic)
+	}
+	d.pending = 0
+	d.mu.Unlock()
+
+	for _, pending := range publishes {
+		pending.publish()
+	}
+}
+
+// drop discards every pending message, used on shutdown with delay_shutdown
+// "drop", and returns how many there were.
+func (d *delayer) drop() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dropped := d.pending
+	for topic, queue := range d.queues {
+		queue.timer.Stop()
+		delete(d.queues, topic)
+	}
+	d.pending = 0
+	return dropped
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDelayerKeepsOrder(t *testing.T) {
+	var published publishes
+	delayer := newDelayer(10 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		delayer.schedule("a", published.publish(fmt.Sprint(i)))
+	}
+	waitFor(t, "the delayed publishes", func() bool { return len(published.get()) == 5 })
+	if got, want := published.get(), []string{"0", "1", "2", "3", "4"}; !slices.Equal(got, want) {
+		t.Errorf("got publishes %q, want %q", got, want)
+	}
+}
+
+func TestDelayerPublishesWithoutLock(t *testing.T) {
+	var published publishes
+	delayer := newDelayer(10 * time.Millisecond)
+	// A publish scheduling another one would deadlock if published with the
+	// lock held.
+	delayer.schedule("a", func() {
+		published.publish("1")()
+		delayer.schedule("a", published.publish("2"))
+	})
+	waitFor(t, "the publish delayed by a publish", func() bool { return len(published.get()) == 2 })
+}
+
+func TestDelayerDropsWhenFull(t *testing.T) {
+	var published publishes
+	delayer := newDelayer(time.Hour)
+	for i := 0; i < maxDelayed; i++ {
+		if !delayer.schedule(fmt.Sprint("topic/", i%10), published.publish(fmt.Sprint(i))) {
+			t.Fatalf("publish %d dropped before the delayer is full", i)
+		}
+	}
+	if delayer.schedule("other", published.publish("over")) {
+		t.Error("publish accepted with the delayer full")
+	}
+
+	delayer.flush()
+	if got := len(published.get()); got != maxDelayed {
+		t.Errorf("flushed %d publishes, want %d", got, maxDelayed)
+	}
+	if !delayer.schedule("other", published.publish("after")) {
+		t.Error("publish dropped after flushing the delayer")
+	}
+	if dropped := delayer.drop(); dropped != 1 {
+		t.Errorf("dropped %d publishes, want 1", dropped)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deltaFilter remembers the last numeric value published to each destination
+// topic so values within minDelta of it can be suppressed. A value is sent
+// anyway once maxAge (if not 0) has passed since the last one was published.
+// Only the maxTopicStates most recently published topics are remembered.
+type deltaFilter struct {
+	mu       sync.Mutex
+	minDelta float64
+	maxAge   time.Duration
+	last     *topicStates[publishedValue]
+}
+
+type publishedValue struct {
+	value float64
+	at    time.Time
+}
+
+func newDeltaFilter(minDelta float64, maxAge time.Duration) *deltaFilter {
+	return &deltaFilter{minDelta: minDelta, maxAge: maxAge, last: newTopicStates[publishedValue](maxTopicStates)}
+}
+
+// suppressed reports whether payload differs by less than the minimum delta
+// from the last value published to topic, recording it as the last one
+// otherwise. Payloads that aren't numbers are never suppressed.
+func (f *deltaFilter) suppressed(topic string, payload string) bool {
+	value, err := strconv.ParseFloat(strings.TrimSpace(payload), 64)
+	if err != nil || math.IsNaN(value) {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	last, ok := f.last.get(topic)
+	if ok && math.Abs(value-last.value) < f.minDelta && (f.maxAge == 0 || now.Sub(last.at) < f.maxAge) {
+		return true
+	}
+	f.last.set(topic, publishedValue{value: value, at: now})
+	return false
+}
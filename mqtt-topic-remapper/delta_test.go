@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeltaFilter(t *testing.T) {
+	filter := newDeltaFilter(0.5, 0)
+	for _, test := range []struct {
+		topic      string
+		payload    string
+		suppressed bool
+	}{
+		{"a", "20", false},
+		{"a", " 20.4 ", true},
+		{"a", "19.6", true},
+		// Compared to the last published value, not the last received one.
+		{"a", "20.5", false},
+		{"b", "20.5", false},
+		{"a", "unavailable", false},
+		{"a", "20.6", true},
+		{"a", "NaN", false},
+	} {
+		if got := filter.suppressed(test.topic, test.payload); got != test.suppressed {
+			t.Errorf("%q on %s: got suppressed %t, want %t", test.payload, test.topic, got, test.suppressed)
+		}
+	}
+}
+
+func TestDeltaFilterMaxAge(t *testing.T) {
+	filter := newDeltaFilter(1, time.Millisecond)
+	filter.suppressed("a", "20")
+	time.Sleep(2 * time.Millisecond)
+	if filter.suppressed("a", "20") {
+		t.Error("suppressed a value older than the max age")
+	}
+}
+
+func TestDeltaFilterIsBounded(t *testing.T) {
+	filter := newDeltaFilter(1, 0)
+	for i := 0; i < maxTopicStates+10; i++ {
+		filter.suppressed(string(rune(i)), "20")
+	}
+	if filter.last.len() != maxTopicStates {
+		t.Errorf("remembered %d topics, want %d", filter.last.len(), maxTopicStates)
+	}
+}
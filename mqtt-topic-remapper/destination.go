@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Destination is a topic a remapped message is published to. The QoS and
+// retained flag are inherited from the remap when not set.
+//
+// A topic containing {{ is a text/template rendered per message with the
+// fields of the JSON object payload as received, for content-based routing
+// (e.g. "home/{{.device}}/state"). Messages whose payload lacks a field it
+// references, or for which it renders a topic with wildcards or empty levels,
+// are dropped.
+type Destination struct {
+	Topic         string            `toml:"topic"`
+	ValueMappings map[string]string `toml:"message"`
+	PubQoS        *byte             `toml:"pub_qos"`
+	Retained      *bool             `toml:"retained"`
+
+	replacer      *strings.Replacer
+	topicTemplate *template.Template
+}
+
+// Destinations is the "to" of a remap. It can be written in the config either
+// as a single topic string or as a list of destination tables:
+//
+//	to = "home/hallway/motion"
+//
+//	[[remap.to]]
+//	topic = "home/hallway/motion"
+//	pub_qos = 1
+//	retained = true
+//	[remap.to.message]
+//	ON = "1"
+type Destinations []Destination
+
+func (d *Destinations) UnmarshalTOML(data any) error {
+	switch value := data.(type) {
+	case string:
+		*d = Destinations{{Topic: value}}
+	case []map[string]any:
+		for _, table := range value {
+			destination, err := decodeDestination(table)
+			if err != nil {
+				return err
+			}
+			*d = append(*d, destination)
+		}
+	case []any:
+		for _, item := range value {
+			table, ok := item.(map[string]any)
+			if !ok {
+				return fmt.Errorf("invalid destination %v: expected a table", item)
+			}
+			destination, err := decodeDestination(table)
+			if err != nil {
+				return err
+			}
+			*d = append(*d, destination)
+		}
+	default:
+		return fmt.Errorf("invalid to %v: expected a topic or a list of destinations", data)
+	}
+	return nil
+}
+
+func decodeDestination(table map[string]any) (Destination, error) {
+	var destination Destination
+	for key, value := range table {
+		switch key {
+		case "topic":
+			topic, ok := value.(string)
+			if !ok {
+				return destination, fmt.Errorf("invalid destination topic %v: expected a string", value)
+			}
+			destination.Topic = topic
+		case "pub_qos":
+			qos, ok := value.(int64)
+			if !ok || qos < 0 || qos > 2 {
+				return destination, fmt.Errorf("invalid destination pub_qos %v (must be 0, 1 or 2)", value)
+			}
+			pubQoS := byte(qos)
+			destination.PubQoS = &pubQoS
+		case "retained":
+			retained, ok := value.(bool)
+			if !ok {
+				return destination, fmt.Errorf("invalid destination retained %v: expected a boolean", value)
+			}
+			destination.Retained = &retained
+		case "message":
+			mappings, ok := value.(map[string]any)
+			if !ok {
+				return destination, fmt.Errorf("invalid destination message %v: expected a table", value)
+			}
+			destination.ValueMappings = make(map[string]string, len(mappings))
+			for from, to := range mappings {
+				str, ok := to.(string)
+				if !ok {
+					return destination, fmt.Errorf("invalid destination message value %v: expected a string", to)
+				}
+				destination.ValueMappings[from] = str
+			}
+		default:
+			return destination, fmt.Errorf("unknown destination key %s", key)
+		}
+	}
+	if destination.Topic == "" {
+		return destination, fmt.Errorf("destination is missing a topic")
+	}
+	return destination, nil
+}
+
+func (d Destinations) String() string {
+	topics := make([]string, len(d))
+	for i, destination := range d {
+		topics[i] = destination.Topic
+	}
+	return strings.Join(topics, ",")
+}
+
+// isTopicTemplate reports whether topic is rendered with the payload fields.
+func isTopicTemplate(topic string) bool {
+	return strings.Contains(topic, "{{")
+}
+
+// compile parses the topic of d if it is a template.
+func (d *Destination) compile(from string) error {
+	if !isTopicTemplate(d.Topic) {
+		return nil
+	}
+	tmpl, err := template.New(d.Topic).Option("missingkey=error").Parse(d.Topic)
+	if err != nil {
+		return fmt.Errorf("remap from %s: invalid to template %q: %s", from, d.Topic, err)
+	}
+	d.topicTemplate = tmpl
+	return nil
+}
+
+// renderTopic renders the topic template of d with the fields of payload,
+// decoded into document the first time a template needs it.
+func (d Destination) renderTopic(payload string, document *any) (string, error) {
+	if *document == nil {
+		value, err := decodeJSON(payload)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := value.(map[string]any); !ok {
+			return "", fmt.Errorf("payload is not a JSON object, to %s references its fields", d.Topic)
+		}
+		*document = value
+	}
+	var out strings.Builder
+	if err := d.topicTemplate.Execute(&out, *document); err != nil {
+		return "", fmt.Errorf("failed to render to %s: %s", d.Topic, err)
+	}
+	return out.String(), nil
+}
+
+// validRenderedTopic reports whether a topic rendered from a template can be
+// published to: it must not have wildcards or empty levels, as an empty
+// payload field would give.
+func validRenderedTopic(topic string) bool {
+	return !isWildcardTopic(topic) && !slices.Contains(strings.Split(topic, "/"), "")
+}
+
+func (d Destination) remap(payload string) string {
+	return replaceValues(payload, d.ValueMappings, d.replacer)
+}
+
+func (d Destination) pubQoS(remap Remap) byte {
+	if d.PubQoS != nil {
+		return *d.PubQoS
+	}
+	return remap.PubQoS
+}
+
+func (d Destination) retained(remap Remap, msg mqtt.Message) bool {
+	if d.Retained != nil && !remap.RetainFromSource {
+		return *d.Retained
+	}
+	return remap.retained(msg)
+}
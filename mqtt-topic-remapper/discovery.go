@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Discovery describes the Home Assistant entity of a remap, announced with a
+// retained MQTT discovery message on startup so that its to shows up in Home
+// Assistant without writing the entity config by hand.
+type Discovery struct {
+	// Component is the Home Assistant integration of the entity, e.g.
+	// "sensor" or "binary_sensor".
+	Component string `toml:"component"`
+	// ID is the object id of the entity, used in the discovery topic and as
+	// its unique id (default derived from to).
+	ID   string `toml:"id"`
+	Name string `toml:"name"`
+	// Device is the name of the device the entity is grouped under in Home
+	// Assistant, which is also used to identify it.
+	Device            string `toml:"device"`
+	DeviceClass       string `toml:"device_class"`
+	UnitOfMeasurement string `toml:"unit_of_measurement"`
+	// RemoveOnShutdown publishes an empty retained discovery message on
+	// shutdown, or when the remap is removed by a reload, which removes the
+	// entity from Home Assistant.
+	RemoveOnShutdown bool `toml:"remove_on_shutdown"`
+}
+
+// discoveryID matches the component and object ids Home Assistant allows in
+// discovery topics, and invalidDiscoveryID the characters it doesn't.
+var (
+	discoveryID        = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	invalidDiscoveryID = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+)
+
+// validateDiscovery returns the problems found in the discovery of r, whose
+// to must be a single topic without placeholders to be used as state topic.
+func (r Remap) validateDiscovery() []error {
+	var errs []error
+	if !discoveryID.MatchString(r.Discovery.Component) {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid discovery component %q (must be letters, digits, _ or -)", r.From, r.Discovery.Component))
+	}
+	if r.Discovery.ID != "" && !discoveryID.MatchString(r.Discovery.ID) {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid discovery id %q (must be letters, digits, _ or -)", r.From, r.Discovery.ID))
+	}
+	if len(r.To) != 1 || strings.Contains(r.To[0].Topic, "{") {
+		errs = append(errs, fmt.Errorf("remap from %s: discovery requires a single to without placeholders", r.From))
+	}
+	return errs
+}
+
+// discoveryObjectID returns the object id of the entity of r, which is the
+// to topic with the characters not allowed replaced unless set.
+func (r Remap) discoveryObjectID() string {
+	if r.Discovery.ID != "" {
+		return r.Discovery.ID
+	}
+	return strings.Trim(invalidDiscoveryID.ReplaceAllString(r.To[0].Topic, "_"), "_")
+}
+
+// discoveryTopic returns the topic the discovery message of r is published
+// to under prefix.
+func (r Remap) discoveryTopic(prefix string) string {
+	return prefix + "/" + r.Discovery.Component + "/" + r.discoveryObjectID() + "/config"
+}
+
+// discoveryPayload returns the entity config of the discovery message of r.
+func (r Remap) discoveryPayload() (string, error) {
+	config := map[string]any{
+		"state_topic": r.To[0].Topic,
+		"unique_id":   r.discoveryObjectID(),
+	}
+	if r.Discovery.Name != "" {
+		config["name"] = r.Discovery.Name
+	}
+	if r.Discovery.DeviceClass != "" {
+		config["device_class"] = r.Discovery.DeviceClass
+	}
+	if r.Discovery.UnitOfMeasurement != "" {
+		config["unit_of_measurement"] = r.Discovery.UnitOfMeasurement
+	}
+	if r.Discovery.Device != "" {
+		config["device"] = map[string]any{
+			"name":        r.Discovery.Device,
+			"identifiers": []string{strings.ToLower(invalidDiscoveryID.ReplaceAllString(r.Discovery.Device, "_"))},
+		}
+	}
+	return encodeJSON(config)
+}
+
+// publishDiscovery publishes the retained discovery messages of the remaps
+// with a discovery under prefix.
+func publishDiscovery(publish func(outgoingMessage), remaps []Remap, prefix string) {
+	for _, remap := range remaps {
+		if remap.Discovery == nil {
+			continue
+		}
+		topic := remap.discoveryTopic(prefix)
+		payload, err := remap.discoveryPayload()
+		if err != nil {
+			remap.logger().Error("Error encoding discovery message", "from", remap.From, "error", err)
+			continue
+		}
+		remap.logger().Debug("Publishing discovery message", "from", remap.From, "topic", topic)
+		publish(outgoingMessage{topic: topic, qos: 1, retained: true, payload: payload, log: remap.logger()})
+	}
+}
+
+// discoveryTopics returns the discovery topics of the remaps with a discovery
+// under prefix.
+func discoveryTopics(remaps []Remap, prefix string) map[string]bool {
+	topics := make(map[string]bool)
+	for _, remap := range remaps {
+		if remap.Discovery != nil {
+			topics[remap.discoveryTopic(prefix)] = true
+		}
+	}
+	return topics
+}
+
+// removeDiscovery publishes an empty retained discovery message for the
+// remaps with remove_on_shutdown, except those whose topic is in keep.
+func removeDiscovery(publish func(outgoingMessage), remaps []Remap, prefix string, keep map[string]bool) {
+	for _, remap := range remaps {
+		if remap.Discovery == nil || !remap.Discovery.RemoveOnShutdown {
+			continue
+		}
+		topic := remap.discoveryTopic(prefix)
+		if keep[topic] {
+			continue
+		}
+		remap.logger().Debug("Removing discovery message", "from", remap.From, "topic", topic)
+		publish(outgoingMessage{topic: topic, qos: 1, retained: true, payload: "", log: remap.logger()})
+	}
+}
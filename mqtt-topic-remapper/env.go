@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// expandEnv expands the ${VAR} and $VAR references in the topics and value
+// mappings of the config: the from, subscribe, to, else_to, split, routes,
+// stale_topic, dead_letter_topic, strip_prefix and add_prefix of the remaps,
+// the to of the batches and merges, the global will_topic, status_topic and
+// dead_letter_topic, and the message and replace values of the remaps, their
+// destinations and pipeline steps. ${VAR:-default} falls back to default when
+// VAR is unset and $$ is an escaped $. Any other $ is left as is. The values of
+// regex remaps are replacement templates, whose $1, $name and $$ references
+// would be taken for variables, so they are never expanded.
+func (c *Config) expandEnv() []error {
+	var errs []error
+	expand := func(value string) string {
+		return expandVariables(value, func(name string) string {
+			name, fallback, hasFallback := strings.Cut(name, ":-")
+			if env, ok := os.LookupEnv(name); ok {
+				return env
+			}
+			if !hasFallback {
+				errs = append(errs, fmt.Errorf("environment variable %s referenced in %q is not set", name, value))
+			}
+			return fallback
+		})
+	}
+	topic := expand
+	expandMappings := func(mappings map[string]string, regex bool) {
+		if regex {
+			return
+		}
+		for from, to := range mappings {
+			mappings[from] = expand(to)
+		}
+	}
+	expandReplacements := func(replacements []Replacement, regex bool) {
+		if regex {
+			return
+		}
+		for i := range replacements {
+			replacements[i].To = expand(replacements[i].To)
+		}
+	}
+
+	c.WillTopic = topic(c.WillTopic)
+	c.StatusTopic = topic(c.StatusTopic)
+	c.DeadLetterTopic = topic(c.DeadLetterTopic)
+	for i := range c.Batches {
+		c.Batches[i].To = topic(c.Batches[i].To)
+	}
+	for i := range c.Merges {
+		c.Merges[i].To = topic(c.Merges[i].To)
+	}
+	for i := range c.Remaps {
+		remap := &c.Remaps[i]
+		remap.From = topic(remap.From)
+		remap.Subscribe = topic(remap.Subscribe)
+		remap.ElseTo = topic(remap.ElseTo)
+		remap.StaleTopic = topic(remap.StaleTopic)
+		remap.DeadLetterTopic = topic(remap.DeadLetterTopic)
+		remap.StripPrefix = topic(remap.StripPrefix)
+		remap.AddPrefix = topic(remap.AddPrefix)
+		for j := range remap.To {
+			remap.To[j].Topic = topic(remap.To[j].Topic)
+			expandMappings(remap.To[j].ValueMappings, remap.Regex)
+		}
+		for field, to := range remap.Split {
+			remap.Split[field] = topic(to)
+		}
+		for j := range remap.Routes {
+			remap.Routes[j].To = topic(remap.Routes[j].To)
+		}
+		expandMappings(remap.ValueMappings, remap.Regex)
+		expandReplacements(remap.Replacements, remap.Regex)
+		for _, step := range remap.Pipeline {
+			expandMappings(step.ValueMappings, step.Regex)
+			expandReplacements(step.Replacements, step.Regex)
+		}
+	}
+	return errs
+}
+
+// expandVariables replaces the ${name} and $name references in value with
+// lookup(name), where name starts with a letter or an underscore, and $$ with
+// a single $. The rest of the text is left as is.
+func expandVariables(value string, lookup func(name string) string) string {
+	var expanded strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 == len(value) {
+			expanded.WriteByte(value[i])
+			continue
+		}
+		rest := value[i+1:]
+		switch {
+		case rest[0] == '$':
+			expanded.WriteByte('$')
+			i++
+		case rest[0] == '{':
+			name, _, closed := strings.Cut(rest[1:], "}")
+			if closed && len(name) > 0 && isVariableStart(name[0]) {
+				expanded.WriteString(lookup(name))
+				i += len(name) + 2
+			} else {
+				expanded.WriteByte('$')
+			}
+		case isVariableStart(rest[0]):
+			end := 1
+			for end < len(rest) && (isVariableStart(rest[end]) || isDigit(rest[end])) {
+				end++
+			}
+			expanded.WriteString(lookup(rest[:end]))
+			i += end
+		default:
+			expanded.WriteByte('$')
+		}
+	}
+	return expanded.String()
+}
+
+func isVariableStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandVariables(t *testing.T) {
+	lookup := func(name string) string { return "<" + name + ">" }
+	for _, test := range []struct {
+		value string
+		want  string
+	}{
+		{"home/${ROOM}/temp", "home/<ROOM>/temp"},
+		{"home/$ROOM/temp", "home/<ROOM>/temp"},
+		{"${ROOM:-kitchen}", "<ROOM:-kitchen>"},
+		{"$ROOM_2x", "<ROOM_2x>"},
+		{"costs $$5", "costs $5"},
+		// Anything that isn't a variable reference is left unchanged.
+		{"costs $5", "costs $5"},
+		{"${5} and ${} and ${ROOM", "${5} and ${} and ${ROOM"},
+		{"$ $- $? $", "$ $- $? $"},
+	} {
+		if got := expandVariables(test.value, lookup); got != test.want {
+			t.Errorf("expanding %q: got %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("ROOM", "kitchen")
+	config, _ := loadTestConfig(t, `
+status_topic = "remapper/${ROOM}/status"
+
+[[remap]]
+from = "in/$ROOM"
+to = "out/${ROOM}"
+else_to = "else/$ROOM"
+condition = "value > 0"
+stale_after = "1m"
+stale_topic = "stale/$ROOM"
+message = { on = "$ROOM costs $5" }
+
+[[remap]]
+from = "split/in"
+split = { temperature = "split/$ROOM/temperature" }
+
+[[remap]]
+from = "routes/in"
+routes = [{ to = "routes/$ROOM" }]
+
+[[remap]]
+from = "regex/in"
+to = "regex/out"
+regex = true
+message = { "(on|off) in (?P<room>.*)" = "${1} in $room, costs $$5" }
+
+[[remap]]
+from = "replace/in"
+to = "replace/out"
+regex = true
+replace = [{ from = "(?P<state>on|off)", to = "${state} in $ROOM" }]
+`)
+	remap := config.Remaps[0]
+	for _, test := range []struct{ got, want string }{
+		{config.StatusTopic, "remapper/kitchen/status"},
+		{remap.From, "in/kitchen"},
+		{remap.To[0].Topic, "out/kitchen"},
+		{remap.ElseTo, "else/kitchen"},
+		{remap.StaleTopic, "stale/kitchen"},
+		{remap.ValueMappings["on"], "kitchen costs $5"},
+		{config.Remaps[1].Split["temperature"], "split/kitchen/temperature"},
+		{config.Remaps[2].Routes[0].To, "routes/kitchen"},
+		// Regex replacement templates are left alone, named groups included.
+		{config.Remaps[3].ValueMappings["(on|off) in (?P<room>.*)"], "${1} in $room, costs $$5"},
+		{config.Remaps[4].Replacements[0].To, "${state} in $ROOM"},
+	} {
+		if test.got != test.want {
+			t.Errorf("got %q, want %q", test.got, test.want)
+		}
+	}
+	checkRemap(t, config.Remaps[3], []remapTest{{"on in bedroom", "on in bedroom, costs $5"}})
+}
+
+func TestExpandEnvUnset(t *testing.T) {
+	config := Config{Remaps: []Remap{{From: "in/${UNSET_ROOM}", To: Destinations{{Topic: "out/${UNSET_ROOM:-default}"}}}}}
+	errs := config.expandEnv()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "UNSET_ROOM") {
+		t.Errorf("got errors %v, want UNSET_ROOM not set", errs)
+	}
+	if config.Remaps[0].To[0].Topic != "out/default" {
+		t.Errorf("got to %q, want the default", config.Remaps[0].To[0].Topic)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// commandRunner pipes payloads through an external command, allowing at most
+// cap(slots) of them to run at once.
+type commandRunner struct {
+	command []string
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+func newCommandRunner(command []string, timeout time.Duration, concurrency int) *commandRunner {
+	return &commandRunner{command: command, timeout: timeout, slots: make(chan struct{}, concurrency)}
+}
+
+// run writes payload to the stdin of the command and returns its stdout,
+// without the trailing newline. The command is killed after the timeout and a
+// non-zero exit status is returned as an error including its stderr.
+func (c *commandRunner) run(payload string) (string, error) {
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.command[0], c.command[1:]...)
+	cmd.Stdin = strings.NewReader(payload)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Don't wait for children of a killed command that keep its output open.
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("command %s timed out after %s", c.command[0], c.timeout)
+		}
+		return "", fmt.Errorf("command %s failed: %s: %s", c.command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSuffix(stdout.String(), "\n"), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// expressionFunctions are the math functions available in expressions on top
+// of the expr builtins (abs, ceil, floor, round, min, max, ...).
+var expressionFunctions = map[string]func(float64) float64{
+	"log":   math.Log,
+	"log2":  math.Log2,
+	"log10": math.Log10,
+	"exp":   math.Exp,
+	"sqrt":  math.Sqrt,
+}
+
+// compileExpression compiles an arithmetic expression over the numeric payload
+// x, e.g. "(x - 32) * 5 / 9".
+func compileExpression(expression string) (*vm.Program, error) {
+	options := []expr.Option{
+		expr.Env(map[string]any{"x": 0.0}),
+		expr.AsFloat64(),
+		expr.Function("pow", func(params ...any) (any, error) {
+			return math.Pow(params[0].(float64), params[1].(float64)), nil
+		}, new(func(float64, float64) float64)),
+	}
+	for name, function := range expressionFunctions {
+		function := function
+		options = append(options, expr.Function(name, func(params ...any) (any, error) {
+			return function(params[0].(float64)), nil
+		}, new(func(float64) float64)))
+	}
+	return expr.Compile(expression, options...)
+}
+
+// evaluateExpression evaluates the compiled expression with x set to the
+// numeric payload and returns the result.
+func evaluateExpression(program *vm.Program, payload string) (float64, error) {
+	x, err := strconv.ParseFloat(strings.TrimSpace(payload), 64)
+	if err != nil {
+		return 0, fmt.Errorf("payload %q is not a number", payload)
+	}
+	result, err := expr.Run(program, map[string]any{"x": x})
+	if err != nil {
+		return 0, fmt.Errorf("failed to evaluate expression: %s", err)
+	}
+	value := result.(float64)
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("expression evaluated to %g for payload %q", value, payload)
+	}
+	return value, nil
+}
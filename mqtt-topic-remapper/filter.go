@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// errFiltered is returned by remap when a message is dropped by the
+// allow/deny filters.
+var errFiltered = errors.New("payload filtered out")
+
+// allowed reports whether the remapped payload passes the allow/deny lists and
+// numeric bounds, and if not why.
+func (r Remap) allowed(payload string) (bool, string) {
+	if len(r.AllowValues) > 0 && !slices.Contains(r.AllowValues, payload) {
+		return false, "not in allow_values"
+	}
+	if slices.Contains(r.DenyValues, payload) {
+		return false, "in deny_values"
+	}
+	if r.Min == nil && r.Max == nil {
+		return true, ""
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(payload), 64)
+	if err != nil {
+		return false, "not a number"
+	}
+	if r.Min != nil && value < *r.Min {
+		return false, "below min"
+	}
+	if r.Max != nil && value > *r.Max {
+		return false, "above max"
+	}
+	return true, ""
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configExtensions are the extensions of the config files loaded from a
+// config directory.
+var configExtensions = []string{".toml", ".yaml", ".yml", ".json"}
+
+// configFiles returns the config files to load for paths, in order: files as
+// given and, for directories, the config files they contain sorted by name.
+func configFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			// Missing files are reported when decoding them.
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var found bool
+		for _, entry := range entries {
+			extension := strings.ToLower(filepath.Ext(entry.Name()))
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !slices.Contains(configExtensions, extension) {
+				continue
+			}
+			files = append(files, filepath.Join(path, entry.Name()))
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("no config files (%s) found in directory %s", strings.Join(configExtensions, ", "), path)
+		}
+	}
+	return files, nil
+}
+
+// decodeConfigFiles decodes files into config one after the other. The
+// remaps, batches, merges and mappings of every file are combined, while the
+// global settings of a file override those of the previous files. Each file
+// is validated against its own config version.
+func decodeConfigFiles(files []string, config *Config) error {
+	var remaps []Remap
+	var batches []Batch
+	var merges []Merge
+	mappings := make(map[string]map[string]string)
+	mappingFiles := make(map[string]string)
+	var errs []error
+	for _, file := range files {
+		slog.Debug("Loading config from file", "file", file)
+		config.Remaps, config.Batches, config.Merges, config.Mappings = nil, nil, nil, nil
+		config.Version = 0
+		if err := decodeConfigFile(file, config); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("config file not found, set -config to its path: %w", err)
+			}
+			return err
+		}
+		errs = append(errs, config.validateVersion(file)...)
+		for i := range config.Remaps {
+			config.Remaps[i].file = file
+		}
+		remaps = append(remaps, config.Remaps...)
+		batches = append(batches, config.Batches...)
+		merges = append(merges, config.Merges...)
+		for name, set := range config.Mappings {
+			if other, ok := mappingFiles[name]; ok {
+				return fmt.Errorf("mappings %s defined in both %s and %s", name, other, file)
+			}
+			mappings[name], mappingFiles[name] = set, file
+		}
+	}
+	config.Remaps, config.Batches, config.Merges, config.Mappings = remaps, batches, merges, mappings
+	return errors.Join(errs...)
+}
+
+// decodeConfigFile decodes file into config using the format given by its
+// extension. YAML and JSON configs are converted to TOML before decoding, so
+// every format accepts the same keys and values (durations such as "30s"
+// included) without duplicating the struct tags and custom decoders.
+func decodeConfigFile(file string, config *Config) error {
+	var decode func([]byte, any) error
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		decode = yaml.Unmarshal
+	case ".json":
+		decode = json.Unmarshal
+	default:
+		meta, err := toml.DecodeFile(file, config)
+		if err == nil {
+			warnUndecoded(file, meta)
+		}
+		return err
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var document map[string]any
+	if err := decode(data, &document); err != nil {
+		return err
+	}
+
+	normalized, err := normalizeDocument(document, "")
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	var encoded bytes.Buffer
+	if err := toml.NewEncoder(&encoded).Encode(normalized); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	meta, err := toml.Decode(encoded.String(), config)
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	warnUndecoded(file, meta)
+	return nil
+}
+
+// normalizeDocument prepares a decoded YAML or JSON document, the value at
+// path, to be encoded as TOML: keys set to null are left out like unset ones,
+// and whole JSON numbers become integers so they can be decoded into integer
+// fields. TOML has no null, so nulls in arrays are an error rather than being
+// dropped, which would shift the elements after them.
+func normalizeDocument(value any, path string) (any, error) {
+	switch value := value.(type) {
+	case map[string]any:
+		normalized := make(map[string]any, len(value))
+		for key, element := range value {
+			if element == nil {
+				continue
+			}
+			elementPath := key
+			if path != "" {
+				elementPath = path + "." + key
+			}
+			var err error
+			if normalized[key], err = normalizeDocument(element, elementPath); err != nil {
+				return nil, err
+			}
+		}
+		return normalized, nil
+	case []any:
+		normalized := make([]any, len(value))
+		for i, element := range value {
+			elementPath := fmt.Sprintf("%s[%d]", path, i)
+			if element == nil {
+				return nil, fmt.Errorf("%s is null, which can't be used in an array", elementPath)
+			}
+			var err error
+			if normalized[i], err = normalizeDocument(element, elementPath); err != nil {
+				return nil, err
+			}
+		}
+		return normalized, nil
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+			return int64(value), nil
+		}
+		return value, nil
+	default:
+		return value, nil
+	}
+}
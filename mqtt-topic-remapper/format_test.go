@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeTestFile decodes contents written to a config file named name.
+func decodeTestFile(t *testing.T, name string, contents string) (Config, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var config Config
+	err := decodeConfigFile(file, &config)
+	return config, err
+}
+
+func TestDecodeConfigFormats(t *testing.T) {
+	want, err := decodeTestFile(t, "config.toml", `
+version = 2
+max_inflight = 4
+drain_timeout = "2s"
+
+[[remap]]
+from = "zigbee/+/temperature"
+to = "home/{1}/temperature"
+scale = 0.5
+decimals = 0
+exec = ["tr", "a-z", "A-Z"]
+threshold = { value = 20, above = "hot", below = "cold" }
+routes = [{ when = "on", to = "a" }, { to = "b" }]
+
+[[remap]]
+from = "in"
+to = "out"
+retained = true
+message = { on = "ON" }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want.Remaps) != 2 || want.Remaps[0].Decimals == nil || len(want.Remaps[0].Routes) != 2 {
+		t.Fatalf("decoded TOML config %+v is missing values", want)
+	}
+
+	for name, contents := range map[string]string{
+		"config.yaml": `
+version: 2
+max_inflight: 4
+drain_timeout: 2s
+remap:
+  - from: zigbee/+/temperature
+    to: home/{1}/temperature
+    scale: 0.5
+    decimals: 0
+    exec: [tr, a-z, A-Z]
+    threshold: { value: 20, above: hot, below: cold }
+    routes:
+      - { when: "on", to: a }
+      - to: b
+    # Keys set to null are the same as unset ones.
+    offset: null
+  - from: in
+    to: out
+    retained: true
+    message: { "on": "ON" }
+`,
+		"config.json": `{
+  "version": 2,
+  "max_inflight": 4,
+  "drain_timeout": "2s",
+  "remap": [
+    {
+      "from": "zigbee/+/temperature",
+      "to": "home/{1}/temperature",
+      "scale": 0.5,
+      "decimals": 0,
+      "exec": ["tr", "a-z", "A-Z"],
+      "threshold": {"value": 20, "above": "hot", "below": "cold"},
+      "routes": [{"when": "on", "to": "a"}, {"to": "b"}],
+      "offset": null
+    },
+    {"from": "in", "to": "out", "retained": true, "message": {"on": "ON"}}
+  ]
+}`,
+	} {
+		got, err := decodeTestFile(t, name, contents)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want the same config as TOML %+v", name, got, want)
+		}
+	}
+}
+
+func TestDecodeConfigNullInArray(t *testing.T) {
+	for name, contents := range map[string]string{
+		"config.yaml": "remap:\n  - from: in\n    to: out\n    exec: [tr, null, A-Z]\n",
+		"config.json": `{"remap": [{"from": "in", "to": "out", "exec": ["tr", null, "A-Z"]}]}`,
+	} {
+		_, err := decodeTestFile(t, name, contents)
+		if err == nil || !strings.Contains(err.Error(), "remap[0].exec[1] is null") {
+			t.Errorf("%s: got error %v, want remap[0].exec[1] is null", name, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// compileGlob compiles a glob value mapping into a pattern matching the whole
+// payload, each * in the key capturing the text that the * at the same
+// position in to is replaced with.
+func compileGlob(from string, to string, caseInsensitive bool) (valuePattern, error) {
+	parts := strings.Split(from, "*")
+	if wildcards := strings.Count(to, "*"); wildcards > len(parts)-1 {
+		return valuePattern{}, fmt.Errorf("value %q has %d wildcards but the key only %d", to, wildcards, len(parts)-1)
+	}
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	expr := "^" + strings.Join(parts, "(.*?)") + "$"
+	if caseInsensitive {
+		expr = "(?i)" + expr
+	}
+
+	var replacement strings.Builder
+	wildcard := 0
+	for _, r := range strings.ReplaceAll(to, "$", "$$") {
+		if r != '*' {
+			replacement.WriteRune(r)
+			continue
+		}
+		wildcard++
+		replacement.WriteString("${" + strconv.Itoa(wildcard) + "}")
+	}
+	return valuePattern{regex: regexp.MustCompile(expr), replacement: replacement.String()}, nil
+}
+
+// replaceGlob replaces payload using the first glob it matches, returning it
+// unchanged if none does.
+func replaceGlob(payload string, globs []valuePattern) string {
+	for _, glob := range globs {
+		if glob.regex.MatchString(payload) {
+			return glob.regex.ReplaceAllString(payload, glob.replacement)
+		}
+	}
+	return payload
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultInvertValues are the true/false pairs swapped by invert unless the
+// remap sets invert_values.
+var defaultInvertValues = [][]string{{"ON", "OFF"}, {"true", "false"}, {"1", "0"}}
+
+// validateInvert returns the problems found in the invert options of r.
+func (r Remap) validateInvert() []error {
+	var errs []error
+	if len(r.InvertValues) > 0 && !r.Invert {
+		errs = append(errs, fmt.Errorf("remap from %s: invert_values is set without invert", r.From))
+	}
+	if len(r.InvertValues) > 0 && (len(r.InvertValues) != 2 || r.InvertValues[0] == r.InvertValues[1]) {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid invert_values %q (must be two different values)", r.From, r.InvertValues))
+	}
+	if r.Invert && (len(r.ValueMappings) > 0 || len(r.Replacements) > 0 || r.Default != nil || r.DropUnmatched || r.Threshold != nil) {
+		errs = append(errs, fmt.Errorf("remap from %s: invert can't be used together with message, replace, default, drop_unmatched and threshold", r.From))
+	}
+	return errs
+}
+
+// inversions returns the exact value mappings swapping the values of each
+// true/false pair, lowercased with case_insensitive.
+func (r Remap) inversions() map[string]string {
+	pairs := defaultInvertValues
+	if len(r.InvertValues) > 0 {
+		pairs = [][]string{r.InvertValues}
+	}
+	inversions := make(map[string]string, 2*len(pairs))
+	for _, pair := range pairs {
+		on, off := pair[0], pair[1]
+		if r.CaseInsensitive {
+			inversions[strings.ToLower(on)], inversions[strings.ToLower(off)] = off, on
+		} else {
+			inversions[on], inversions[off] = off, on
+		}
+	}
+	return inversions
+}
+
+// invert returns the other value of the pair payload belongs to, and the
+// payload unchanged if it isn't one of them.
+func (r Remap) invert(payload string) string {
+	key := payload
+	if r.CaseInsensitive {
+		key = strings.ToLower(payload)
+	}
+	if inverted, ok := r.inverted[key]; ok {
+		return inverted
+	}
+	return payload
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ohler55/ojg/oj"
+)
+
+const (
+	jsonPathFirst = "first"
+	jsonPathDrop  = "drop"
+)
+
+// transformJSONPath transforms the value matched by the remap jsonpath. It is
+// returned on its own, or written back into the document with
+// jsonpath_rewrite. Payloads where the expression matches nothing are dropped,
+// as are those where it matches several values with jsonpath_multiple "drop".
+func (r Remap) transformJSONPath(topic string, payload string) (string, error) {
+	// ojg parses numbers as int64 or float64 instead of json.Number, which
+	// its filters can't compare.
+	document, err := oj.ParseString(payload)
+	if err != nil {
+		return "", fmt.Errorf("payload is not valid JSON: %s", err)
+	}
+
+	matches := r.jsonPath.Get(document)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("jsonpath %s matches nothing in payload", r.JSONPath)
+	}
+	if len(matches) > 1 && r.JSONPathMultiple == jsonPathDrop {
+		return "", fmt.Errorf("jsonpath %s matches %d values in payload", r.JSONPath, len(matches))
+	}
+
+	value, isString := matches[0].(string)
+	if !isString {
+		if value, err = encodeJSON(matches[0]); err != nil {
+			return "", err
+		}
+	}
+	if value, err = r.transformValue(topic, value); err != nil || !r.JSONPathRewrite {
+		return value, err
+	}
+
+	// Keep the type of the matched value: a string stays a string, anything
+	// else is written back as JSON when the transformed value is valid JSON.
+	var rewritten any = value
+	if !isString {
+		if parsed, err := oj.ParseString(value); err == nil {
+			rewritten = parsed
+		}
+	}
+	if err := r.jsonPath.SetOne(document, rewritten); err != nil {
+		return "", fmt.Errorf("rewriting jsonpath %s: %s", r.JSONPath, err)
+	}
+	return encodeJSON(document)
+}
@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestJSONPath(t *testing.T) {
+	payload := `{"sensors":[{"id":"a","temp":21.5},{"id":"b","temp":19,"name":"hall"}]}`
+	for _, test := range []struct {
+		config string
+		want   string
+	}{
+		{`jsonpath = "$.sensors[0].temp"`, "21.5"},
+		{`jsonpath = "$.sensors[?(@.id == 'b')].temp"`, "19"},
+		{`jsonpath = "$.sensors[1].name"`, "hall"},
+		// Objects and arrays are published as JSON.
+		{`jsonpath = "$.sensors[0]"`, `{"id":"a","temp":21.5}`},
+		// The first of several matches by default.
+		{`jsonpath = "$.sensors[*].temp"`, "21.5"},
+		// The matched value is transformed like a payload.
+		{`jsonpath = "$.sensors[1].temp"
+scale = 2.0`, "38"},
+	} {
+		remap := testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+`+test.config)
+		checkRemap(t, remap, []remapTest{{payload, test.want}})
+	}
+}
+
+func TestJSONPathRewrite(t *testing.T) {
+	remap := testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+jsonpath = "$.sensors[0].temp"
+jsonpath_rewrite = true
+scale = 2.0
+`)
+	checkRemap(t, remap, []remapTest{
+		// The rest of the document is kept, and numbers stay numbers.
+		{`{"sensors":[{"id":"a","temp":21.5}],"at":1}`, `{"at":1,"sensors":[{"id":"a","temp":43}]}`},
+	})
+
+	remap = testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+jsonpath = "$.state"
+jsonpath_rewrite = true
+match = "exact"
+message = { ON = "true" }
+`)
+	checkRemap(t, remap, []remapTest{
+		// Strings stay strings even when the new value is valid JSON.
+		{`{"state":"ON"}`, `{"state":"true"}`},
+	})
+}
+
+func TestJSONPathDropped(t *testing.T) {
+	remap := testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+jsonpath = "$.sensors[*].temp"
+jsonpath_multiple = "drop"
+`)
+	for _, payload := range []string{
+		`{"sensors":[{"temp":1},{"temp":2}]}`,
+		`{"sensors":[]}`,
+		`not json`,
+	} {
+		if got, err := remap.remapPayload(remap.From, nil, payload); err == nil {
+			t.Errorf("remapping %q: got %q, want it dropped", payload, got)
+		}
+	}
+	checkRemap(t, remap, []remapTest{{`{"sensors":[{"temp":1}]}`, "1"}})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// setupLogger installs the default structured logger, using the level from
+// the LOG_LEVEL env var (debug, info, warn or error, default info).
+//
+// Logs are written to stdout as text. If LOG_FILE is set they are also written
+// to that file as JSON, rotated once it reaches LOG_MAX_SIZE megabytes
+// (default 100), keeping at most LOG_MAX_BACKUPS old files (default all) for
+// LOG_MAX_AGE days (default forever).
+func setupLogger() error {
+	var level slog.Level
+	if name := os.Getenv("LOG_LEVEL"); name != "" {
+		if err := level.UnmarshalText([]byte(strings.ToUpper(name))); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL %s: %s", name, err)
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(os.Stdout, options)
+	if file := os.Getenv("LOG_FILE"); file != "" {
+		maxSize, err := intEnv("LOG_MAX_SIZE")
+		if err != nil {
+			return err
+		}
+		maxBackups, err := intEnv("LOG_MAX_BACKUPS")
+		if err != nil {
+			return err
+		}
+		maxAge, err := intEnv("LOG_MAX_AGE")
+		if err != nil {
+			return err
+		}
+		writer := &lumberjack.Logger{Filename: file, MaxSize: maxSize, MaxBackups: maxBackups, MaxAge: maxAge}
+		handler = teeHandler{handler, slog.NewJSONHandler(writer, options)}
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func intEnv(name string) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %s (must be a positive integer)", name, value)
+	}
+	return n, nil
+}
+
+// teeHandler sends every record to all of its handlers.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range t {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	var errs []error
+	for _, handler := range t {
+		if handler.Enabled(ctx, record.Level) {
+			errs = append(errs, handler.Handle(ctx, record.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, handler := range t {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, handler := range t {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return handlers
+}
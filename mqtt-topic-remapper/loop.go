@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkLoops returns an error for every cycle of remaps publishing to the
+// topics of one another, around which a message would be remapped forever,
+// e.g. a remap from a to b and another from b back to a. The copies of the
+// passthrough remaps and the messages of the two remaps of a bidirectional
+// remap are ignored by the remap receiving them, so they don't loop. Only the
+// topics known at load time are checked, not those with placeholders or
+// rendered from the payload.
+func checkLoops(remaps []Remap) []error {
+	table := newRemapTable(remaps)
+	// The froms of the enabled remaps are unique.
+	index := make(map[string]int, len(remaps))
+	for i, remap := range remaps {
+		index[remap.From] = i
+	}
+	next := make([][]int, len(remaps))
+	for i, remap := range remaps {
+		for _, topic := range remap.publishedTopics() {
+			other, _, ok := table.find(topic)
+			if !ok || (remap.reverseEchoes && other.echoes == remap.echoes) {
+				continue
+			}
+			next[i] = append(next[i], index[other.From])
+		}
+	}
+
+	var errs []error
+	for start := range remaps {
+		loop, ok := findLoop(next, start)
+		if !ok {
+			continue
+		}
+		froms := []string{remaps[start].From}
+		for _, i := range loop {
+			froms = append(froms, remaps[i].From)
+		}
+		froms = append(froms, remaps[start].From)
+		errs = append(errs, fmt.Errorf("remap from %s: publishes to topics remapped back to it (%s), which would loop forever", remaps[start].From, strings.Join(froms, " -> ")))
+	}
+	return errs
+}
+
+// findLoop returns the remaps a message goes through from start until it is
+// remapped by start again, if it can be. Only the remaps after start are
+// followed, so that each loop is reported once, for its first remap.
+func findLoop(next [][]int, start int) ([]int, bool) {
+	visited := make(map[int]bool)
+	var visit func(i int) ([]int, bool)
+	visit = func(i int) ([]int, bool) {
+		for _, j := range next[i] {
+			if j == start {
+				return nil, true
+			}
+			if j < start || visited[j] {
+				continue
+			}
+			visited[j] = true
+			if loop, ok := visit(j); ok {
+				return append([]int{j}, loop...), true
+			}
+		}
+		return nil, false
+	}
+	return visit(start)
+}
+
+// publishedTopics returns the topics r publishes the remapped messages to
+// that are known at load time, without placeholders.
+func (r Remap) publishedTopics() []string {
+	var topics []string
+	add := func(topic string) {
+		if topic != "" && !isTopicTemplate(topic) && !capturePlaceholder.MatchString(topic) {
+			topics = append(topics, topic)
+		}
+	}
+	for _, destination := range r.To {
+		add(destination.Topic)
+	}
+	for _, topic := range r.Split {
+		add(topic)
+	}
+	for _, route := range r.Routes {
+		add(route.To)
+	}
+	add(r.ElseTo)
+	return topics
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckLoops(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// loop is the loop reported, empty if the config is valid.
+		loop string
+	}{
+		{
+			name: "chain",
+			config: `
+[[remap]]
+from = "a"
+to = "b"
+[[remap]]
+from = "b"
+to = "c"`,
+		},
+		{
+			name: "two remaps",
+			config: `
+[[remap]]
+from = "a"
+to = "b"
+[[remap]]
+from = "b"
+to = "a"`,
+			loop: "a -> b -> a",
+		},
+		{
+			name: "through a wildcard",
+			config: `
+[[remap]]
+from = "a/+"
+to = "b"
+[[remap]]
+from = "b"
+split = { value = "c" }
+[[remap]]
+from = "c"
+routes = [{ when = "1", to = "a/1" }]`,
+			loop: "a/+ -> b -> c -> a/+",
+		},
+		{
+			name: "wildcard remapping to itself",
+			config: `
+[[remap]]
+from = "a/#"
+to = "a/out"`,
+			loop: "a/# -> a/#",
+		},
+		{
+			name: "else_to",
+			config: `
+[[remap]]
+from = "a"
+to = "b"
+condition = "> 1"
+else_to = "c"
+[[remap]]
+from = "c"
+to = "a"`,
+			loop: "a -> c -> a",
+		},
+		{
+			name: "passthrough",
+			config: `
+[[remap]]
+from = "a"
+to = "b"
+passthrough = true
+[[remap]]
+from = "b"
+to = "a"`,
+			loop: "a -> b -> a",
+		},
+		{
+			name: "bidirectional",
+			config: `
+[[remap]]
+from = "command"
+to = "state"
+bidirectional = true`,
+		},
+		{
+			name: "bidirectional and another remap",
+			config: `
+[[remap]]
+from = "command"
+to = "state"
+bidirectional = true
+[[remap]]
+from = "state/#"
+to = "command"`,
+		},
+		{
+			name: "placeholders aren't followed",
+			config: `
+[[remap]]
+from = "a/+"
+to = "b/{1}"
+[[remap]]
+from = "b/+"
+to = "a/{1}"`,
+		},
+		{
+			name: "destination broker",
+			config: `
+[destination]
+uri = "tcp://localhost:1884"
+[[remap]]
+from = "a"
+to = "b"
+[[remap]]
+from = "b"
+to = "a"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadConfig([]string{writeTestConfig(t, test.config)})
+			switch {
+			case test.loop == "" && err != nil:
+				t.Errorf("got error %q, want none", err)
+			case test.loop != "" && (err == nil || !strings.Contains(err.Error(), "("+test.loop+")")):
+				t.Errorf("got error %v, want loop %s", err, test.loop)
+			}
+		})
+	}
+}
@@ -1,114 +1,698 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/BurntSushi/toml"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.opentelemetry.io/otel/codes"
+	"log/slog"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-type Config struct {
-	Remaps []Remap `toml:"remap"`
-}
+// configPaths are the values of the -config flag, which can be repeated.
+type configPaths []string
 
-func loadTomlFromFile(file string) (Config, error) {
-	fmt.Println("Loading config from file", file)
-	var config Config
-	var _, err = toml.DecodeFile(file, &config)
-	return config, err
+func (p configPaths) String() string {
+	return strings.Join(p, ",")
 }
 
-type Remap struct {
-	From          string            `toml:"from"`
-	To            string            `toml:"to"`
-	ValueMappings map[string]string `toml:"message"`
+func (p *configPaths) Set(path string) error {
+	*p = append(*p, path)
+	return nil
 }
 
-func (r Remap) remap(payload string) string {
-	for from, to := range r.ValueMappings {
-		payload = strings.ReplaceAll(payload, from, to)
-	}
-	return payload
+// cliFlags are the command line flags used by run.
+type cliFlags struct {
+	configPath configPaths
+	healthAddr string
+	broker     Broker
+	dryRun     bool
+	strict     bool
 }
 
-func createClientOptions(brokerUri string) *mqtt.ClientOptions {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s", brokerUri))
-	opts.SetClientID("mqtt-topic-remapper")
-	opts.SetUsername(os.Getenv("MQTT_USERNAME"))
-	opts.SetPassword(os.Getenv("MQTT_PASSWORD"))
-	return opts
+// Exit codes, so that process supervisors can tell a missing or invalid
+// config, which restarting won't fix, from other failures.
+const (
+	exitError  = 1
+	exitConfig = 2
+)
+
+func main() {
+	os.Exit(execute())
 }
 
-func connect(opts *mqtt.ClientOptions) mqtt.Client {
-	client := mqtt.NewClient(opts)
-	token := client.Connect()
+// Commands, given as the first argument. Without one the remapper is run.
+const (
+	commandRun      = "run"
+	commandValidate = "validate"
+)
+
+// execute runs the command given on the command line with its flags and
+// returns its exit code. Errors are logged and reported through the exit code
+// rather than panicking, which is reserved for bugs.
+func execute() int {
+	command, args := commandRun, os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if command != commandRun && command != commandValidate {
+		fmt.Fprintf(os.Stderr, "Unknown command %q (must be %s or %s)\n", command, commandRun, commandValidate)
+		return exitConfig
+	}
+
+	var flags cliFlags
+	var validateOnly, selftestOnly, migrate bool
+	var selftestTopic string
+	flag.Var(&flags.configPath, "config", "Path to config file (.toml, .yaml, .yml or .json) or directory of config files, can be repeated (default config.toml)")
+	flag.BoolVar(&validateOnly, "validate", false, "Only validate the config file and exit")
+	flag.BoolVar(&migrate, "migrate", false, "Write the config file converted to the current config version to stdout, without its comments, and exit")
+	flag.BoolVar(&selftestOnly, "selftest", false, "Check that messages published to -selftest-topic are received back from the brokers and exit")
+	flag.StringVar(&selftestTopic, "selftest-topic", "mqtt-topic-remapper/selftest", "Topic published to and subscribed by -selftest")
+	flag.StringVar(&flags.broker.URI, "broker", "", "Broker URI, overriding MQTT_SERVER_URI and the [source] table")
+	flag.StringVar(&flags.broker.Username, "username", "", "Broker username, overriding MQTT_USERNAME and the [source] table")
+	flag.StringVar(&flags.broker.Password, "password", "", "Broker password, overriding MQTT_PASSWORD and the [source] table")
+	flag.BoolVar(&flags.dryRun, "dry-run", false, "Remap and log the messages without publishing them")
+	flag.BoolVar(&flags.strict, "strict", false, "Exit when subscribing to a remap fails, e.g. when the broker's ACL refuses it, instead of logging it and continuing without the remap")
+	flag.StringVar(&flags.healthAddr, "health-addr", ":8080", "Listen address of the /healthz and /readyz probes (empty to disable)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [%s|%s] [flags]\n\n", os.Args[0], commandRun, commandValidate)
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-9s remap the messages (default)\n", commandRun)
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-9s load the config, print a report of every remap and its problems, and exit non-zero if it has any\n\nFlags:\n", commandValidate)
+		flag.PrintDefaults()
+	}
+	// Exits with status 2 on invalid flags, like exitConfig.
+	flag.CommandLine.Parse(args)
+	if len(flags.configPath) == 0 {
+		flags.configPath = configPaths{"config.toml"}
+	}
+
+	if err := setupLogger(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error setting up logger:", err)
+		return exitConfig
+	}
 
-	retries := 3
-	for !token.WaitTimeout(3 * time.Second) {
-		if retries == 0 {
-			panic("failed to connect to MQTT server")
+	if migrate {
+		files, err := configFiles(flags.configPath)
+		if err == nil && len(files) != 1 {
+			err = fmt.Errorf("-migrate converts a single config file, got %d", len(files))
+		}
+		if err == nil {
+			err = migrateConfig(os.Stdout, files[0])
+		}
+		if err != nil {
+			slog.Error("Error migrating config file", "file", flags.configPath, "error", err)
+			return exitConfig
 		}
-		fmt.Println("Retrying connection to MQTT server...")
-		retries--
+		return 0
 	}
 
-	if err := token.Error(); err != nil {
-		panic(fmt.Errorf("failed to connect to MQTT server: %s", err))
+	if command == commandValidate {
+		config, err := loadConfig(flags.configPath)
+		printValidationReport(os.Stdout, flags.configPath.String(), config, err)
+		if err != nil {
+			return exitConfig
+		}
+		return 0
 	}
 
-	return client
-}
+	if validateOnly {
+		config, err := loadConfig(flags.configPath)
+		if err != nil {
+			logConfigErrors(flags.configPath.String(), err)
+			return exitConfig
+		}
+		slog.Info("Config is valid", "file", flags.configPath, "remaps", len(config.Remaps), "disabled", config.disabledRemaps)
+		return 0
+	}
 
-func main() {
-	var configPath string
-	flag.StringVar(&configPath, "config", "config.toml", "Path to config file")
-	flag.Parse()
+	if selftestOnly {
+		config, err := loadConfig(flags.configPath)
+		if err != nil {
+			logConfigErrors(flags.configPath.String(), err)
+			return exitConfig
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := selftest(ctx, config, flags, selftestTopic); err != nil {
+			return exitError
+		}
+		return 0
+	}
 
-	fmt.Println("Starting mqtt-topic-remapper...")
+	slog.Info("Starting mqtt-topic-remapper")
+	if flags.dryRun {
+		slog.Warn("Dry run: messages are remapped and logged but nothing is published")
+	}
 
-	config, err := loadTomlFromFile(configPath)
+	config, err := loadConfig(flags.configPath)
 	if err != nil {
-		fmt.Println("Error loading config file:", err)
-		return
+		logConfigErrors(flags.configPath.String(), err)
+		return exitConfig
+	}
+
+	slog.Info("Loaded config", "file", flags.configPath, "remaps", len(config.Remaps), "disabled", config.disabledRemaps)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, config, flags); err != nil {
+		slog.Error("Error running mqtt-topic-remapper", "error", err)
+		return exitError
+	}
+	return 0
+}
+
+// run remaps messages according to config, reloading it from the config file on
+// SIGHUP, until ctx is cancelled. Everything started by it is then shut down
+// in order before it returns: the subscriptions are removed, the pending
+// messages published and the in-flight publishes drained before
+// disconnecting and stopping the HTTP servers.
+func run(ctx context.Context, config Config, flags cliFlags) error {
+	// client subscribes to the remaps and publisher publishes the remapped
+	// messages, they are the same client unless a destination broker is set.
+	var client, publisher mqtt.Client
+	var subscribed atomic.Bool
+	// subscribeFailed receives the subscription errors that stop run with
+	// -strict.
+	subscribeFailed := make(chan error, 1)
+	if flags.healthAddr != "" {
+		healthServer := startHealthServer(flags.healthAddr, func() bool {
+			return subscribed.Load() && client.IsConnectionOpen() && publisher.IsConnectionOpen()
+		})
+		defer stopHttpServer(healthServer)
 	}
 
-	fmt.Println("Loaded config:", config)
+	metricsAddr, ok := os.LookupEnv("METRICS_ADDR")
+	if !ok {
+		metricsAddr = ":9090"
+	}
+	if metricsAddr != "" {
+		metricsServer := startMetricsServer(metricsAddr)
+		defer stopHttpServer(metricsServer)
+	}
 
-	keepAlive := make(chan os.Signal)
-	signal.Notify(keepAlive, os.Interrupt, syscall.SIGTERM)
+	stopTracing, err := startTracing(ctx)
+	if err != nil {
+		return fmt.Errorf("setting up tracing: %w", err)
+	}
+	defer stopTracing()
 
-	opts := createClientOptions(os.Getenv("MQTT_SERVER_URI"))
-	client := connect(opts)
+	opts, err := createClientOptions(config.sourceBroker(flags.broker), config)
+	if err != nil {
+		return fmt.Errorf("creating MQTT client options: %w", err)
+	}
+	publisherOpts := opts
+	if config.Destination != nil {
+		if publisherOpts, err = createClientOptions(*config.Destination, config); err != nil {
+			return fmt.Errorf("creating destination MQTT client options: %w", err)
+		}
+	}
 
-	var remapMap = make(map[string]Remap)
+	var remaps atomic.Pointer[remapTable]
+	table := newRemapTable(config.Remaps)
+	remaps.Store(&table)
 
-	for _, remap := range config.Remaps {
-		remapMap[remap.From] = remap
-		fmt.Printf("Subscribing remap from %s to %s (value mappings: %s)...\n", remap.From, remap.To, remap.ValueMappings)
-		client.Subscribe(remap.From, 0, nil).Wait()
+	buffer := newOfflineBuffer(config, flags.dryRun)
+	if config.RepublishCacheFile != "" {
+		if err := buffer.lastValues.load(config.RepublishCacheFile); err != nil {
+			slog.Warn("Error loading last values, starting without them", "file", config.RepublishCacheFile, "error", err)
+		}
+		defer func() {
+			if err := buffer.lastValues.save(config.RepublishCacheFile); err != nil {
+				slog.Error("Error saving last values", "file", config.RepublishCacheFile, "error", err)
+			}
+		}()
+	}
+	opts.SetMaxReconnectInterval(config.ConnectMaxInterval)
+	publisherOpts.SetMaxReconnectInterval(config.ConnectMaxInterval)
+	if config.WillTopic != "" && !flags.dryRun {
+		publisherOpts.SetWill(config.WillTopic, config.WillPayload, config.WillQoS, config.WillRetained)
+	}
+	if config.StatusTopic != "" && !flags.dryRun {
+		publisherOpts.SetWill(config.StatusTopic, config.StatusOffline, 1, true)
+	}
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		slog.Warn("Lost connection to MQTT server, reconnecting", "error", err)
+		subscribed.Store(false)
+		if config.Destination == nil {
+			buffer.onConnectionLost()
+		}
+	})
+	broker := trackBroker(opts)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		slog.Info("Connected to MQTT server", "broker", broker.Load())
+		// Subscriptions don't survive a reconnect with a clean session, so
+		// every remap is (re)subscribed each time the client connects.
+		for _, remap := range remaps.Load().remaps {
+			remap.logger().Debug("Subscribing remap", "from", remap.From, "to", remap.To, "value_mappings", remap.ValueMappings, "sub_qos", remap.SubQoS, "pub_qos", remap.PubQoS)
+		}
+		if err := subscribe(client, subscriptions(remaps.Load().remaps), config.PublishTimeout); err != nil && flags.strict {
+			select {
+			case subscribeFailed <- err:
+			default:
+			}
+			return
+		}
+		subscribed.Store(true)
+		if config.Destination == nil {
+			if config.StatusTopic != "" && !flags.dryRun {
+				publishStatus(client, config, config.StatusOnline)
+			}
+			buffer.onConnect(client)
+		}
+	})
+	if config.Destination != nil {
+		publisherOpts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			slog.Warn("Lost connection to destination MQTT server, reconnecting", "error", err)
+			buffer.onConnectionLost()
+		})
+		destinationBroker := trackBroker(publisherOpts)
+		publisherOpts.SetOnConnectHandler(func(client mqtt.Client) {
+			slog.Info("Connected to destination MQTT server", "broker", destinationBroker.Load())
+			if config.StatusTopic != "" && !flags.dryRun {
+				publishStatus(client, config, config.StatusOnline)
+			}
+			buffer.onConnect(client)
+		})
 	}
 
-	client.AddRoute("#", func(client mqtt.Client, msg mqtt.Message) {
+	client = mqtt.NewClient(opts)
+	publisher = client
+	if config.Destination != nil {
+		publisher = mqtt.NewClient(publisherOpts)
+	}
+	client.AddRoute("#", func(_ mqtt.Client, msg mqtt.Message) {
+		start := time.Now()
+		messagesReceived.WithLabelValues(msg.Topic()).Inc()
+		span := startMessageSpan(msg.Topic())
+		defer span.End()
+
 		message := string(msg.Payload())
-		remap, ok := remapMap[msg.Topic()]
+		remap, captures, ok := remaps.Load().find(msg.Topic())
 		if !ok {
-			fmt.Printf("Impossible state: No remap found for topic %s\n", msg.Topic())
+			// Possible when a from_regex remap subscribes to a broader topic
+			// than it matches, or for messages of a subscription removed by a
+			// reload that were still in flight.
+			slog.Debug("No remap matches topic, ignoring message", "topic", msg.Topic(), "subscribed", subscribedTo(remaps.Load().remaps, msg.Topic()))
+			countDropped(msg.Topic(), dropNoRemap)
+			return
+		}
+		traceRemap(span, remap)
+		log := remap.logger()
+		if remap.maxPayloadSize > 0 && len(message) > remap.maxPayloadSize {
+			log.Warn("Dropping oversized message", "topic", msg.Topic(), "payload_len", len(message), "max_payload_size", remap.maxPayloadSize)
+			messagesOversized.WithLabelValues(msg.Topic()).Inc()
+			countDropped(msg.Topic(), dropOversized)
 			return
 		}
+		if remap.echoes != nil && remap.echoes.consume(msg.Topic(), message) {
+			log.Debug("Ignoring copy of a message published by the remapper", "topic", msg.Topic())
+			return
+		}
+		if remap.staleWatcher != nil {
+			remap.staleWatcher.seen(msg.Topic(), captures)
+		}
 
-		remappedMessage := remap.remap(string(msg.Payload()))
+		remappedMessage, err := remap.remapPayload(msg.Topic(), captures, message)
+		if errors.Is(err, errUnmatched) {
+			log.Debug("Dropping unmatched message", "topic", msg.Topic(), "payload_len", len(message))
+			countDropped(msg.Topic(), dropUnmatched)
+			return
+		}
+		if errors.Is(err, errFiltered) {
+			log.Debug("Dropping filtered message", "topic", msg.Topic(), "payload_len", len(message), "reason", err)
+			messagesFiltered.WithLabelValues(msg.Topic()).Inc()
+			switch {
+			case !errors.Is(err, errConditionNotMet):
+				countDropped(msg.Topic(), dropFiltered)
+			case remap.ElseTo == "":
+				countDropped(msg.Topic(), dropConditionNotMet)
+			}
+			if errors.Is(err, errConditionNotMet) && remap.ElseTo != "" {
+				buffer.publishAsync(publisher, outgoingMessage{
+					topic:    expandTopic(remap.ElseTo, captures),
+					qos:      remap.PubQoS,
+					retained: remap.retained(msg),
+					payload:  message,
+					log:      log,
+				})
+			}
+			return
+		}
+		var targets []target
+		if err == nil {
+			targets, err = remap.targets(msg.Topic(), captures, message, remappedMessage)
+		}
+		if err != nil {
+			log.Warn("Dropping message", "topic", msg.Topic(), "payload_len", len(message), "error", err)
+			countDropped(msg.Topic(), dropTransformError)
+			span.SetStatus(codes.Error, err.Error())
+			if remap.deadLetterTopic != "" {
+				buffer.publishAsync(publisher, newDeadLetter(remap, msg, err))
+			}
+			return
+		}
+		remapDuration.Observe(time.Since(start).Seconds())
+		traceTargets(span, targets)
+		remappedAt := time.Now()
+
+		// The original payload is already on the source topic.
+		if remap.Passthrough && remappedMessage != message {
+			remap.echoes.expect(msg.Topic(), remappedMessage)
+			buffer.publishAsync(client, outgoingMessage{
+				topic:      msg.Topic(),
+				qos:        remap.PubQoS,
+				retained:   remap.retained(msg),
+				payload:    remappedMessage,
+				log:        log,
+				forgetEcho: func() { remap.echoes.forget(msg.Topic(), remappedMessage) },
+			})
+		}
+
+		if remap.batcher != nil {
+			remap.batcher.add(remap.batchKey(msg.Topic(), captures), remappedMessage)
+		}
+		if remap.merger != nil {
+			remap.merger.update(captures, expandTopic(remap.MergeField, captures), remappedMessage)
+		}
 
-		fmt.Printf("Converting message %s: '%s' -> %s: '%s'\n", msg.Topic(), message, remap.To, remappedMessage)
-		go client.Publish(remap.To, 0, false, remappedMessage)
+		for _, target := range targets {
+			destination, payload := target.destination, target.payload
+			to := destination.Topic
+			if remap.limiter != nil && !remap.limiter.allow(to) {
+				log.Debug("Dropping rate limited message", "from", msg.Topic(), "to", to)
+				messagesRateLimited.WithLabelValues(to).Inc()
+				countDropped(msg.Topic(), dropRateLimited)
+				continue
+			}
+			publish := func() {
+				publishRemapped(publisher, buffer, remap, destination, msg, payload, start, remappedAt)
+			}
+			if remap.delayer != nil {
+				publishNow := publish
+				publish = func() {
+					if !remap.delayer.schedule(to, publishNow) {
+						log.Debug("Delay queue is full, dropping message", "from", msg.Topic(), "to", to)
+						countDropped(msg.Topic(), dropDelayFull)
+					}
+				}
+			}
+			if remap.debouncer != nil {
+				if remap.debouncer.schedule(to, publish) {
+					countDropped(msg.Topic(), dropDebounced)
+				}
+				continue
+			}
+			publish()
+		}
 	})
 
-	<-keepAlive
-	fmt.Println("Shutting down mqtt-topic-remapper...")
-	client.Disconnect(250)
+	publishBatch := func(msg outgoingMessage) {
+		buffer.publishAsync(publisher, msg)
+	}
+	// Before connecting, which can take a while, so that the signals received
+	// meanwhile don't kill the process with their default action. They are
+	// handled once connected.
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	dump := make(chan os.Signal, 1)
+	signal.Notify(dump, syscall.SIGUSR1)
+	defer signal.Stop(hangup)
+	defer signal.Stop(dump)
+	// Before connecting, so that the retained messages received on subscribing
+	// start the timers of the wildcard topics.
+	startStaleWatchers(config.Remaps, publishBatch)
+	defer func() { stopStaleWatchers(config.Remaps) }()
+
+	if publisher != client {
+		if err := connect(ctx, publisher, config); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("connecting to destination MQTT server: %w", err)
+		}
+		defer publisher.Disconnect(250)
+	}
+	if err := connect(ctx, client, config); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("connecting to MQTT server: %w", err)
+	}
+	defer client.Disconnect(250)
+
+	for _, batch := range config.Batches {
+		batch.start(publishBatch)
+	}
+	for _, merge := range config.Merges {
+		merge.start(publishBatch)
+	}
+	publishDiscovery(publishBatch, config.Remaps, config.DiscoveryPrefix)
+
+	for {
+		select {
+		case <-hangup:
+			slog.Info("Received SIGHUP, reloading config")
+			newConfig, err := loadConfig(flags.configPath)
+			if err != nil {
+				logConfigErrors(flags.configPath.String(), err)
+				slog.Error("Error reloading config file, keeping the current config", "file", flags.configPath)
+				continue
+			}
+			for _, batch := range newConfig.Batches {
+				batch.start(publishBatch)
+			}
+			for _, merge := range newConfig.Merges {
+				merge.start(publishBatch)
+			}
+			startStaleWatchers(newConfig.Remaps, publishBatch)
+			if err := reloadRemaps(client, &remaps, config.Remaps, newConfig.Remaps, config.PublishTimeout); err != nil && flags.strict {
+				stopStaleWatchers(newConfig.Remaps)
+				for _, batch := range newConfig.Batches {
+					batch.stop()
+				}
+				for _, merge := range newConfig.Merges {
+					merge.stop()
+				}
+				return err
+			}
+			stopStaleWatchers(config.Remaps)
+			for _, batch := range config.Batches {
+				batch.stop()
+			}
+			for _, merge := range config.Merges {
+				merge.stop()
+			}
+			removeDiscovery(publishBatch, config.Remaps, config.DiscoveryPrefix, discoveryTopics(newConfig.Remaps, newConfig.DiscoveryPrefix))
+			publishDiscovery(publishBatch, newConfig.Remaps, newConfig.DiscoveryPrefix)
+			config = newConfig
+			slog.Info("Reloaded config", "file", flags.configPath, "remaps", len(config.Remaps), "disabled", config.disabledRemaps)
+		case <-dump:
+			// Reloads happen in this loop too, so config is never dumped
+			// while it is being replaced.
+			slog.Info("Received SIGUSR1, dumping the effective config to stderr")
+			if err := dumpConfig(os.Stderr, flags.configPath.String(), config); err != nil {
+				slog.Error("Error dumping config", "error", err)
+			}
+		case err := <-subscribeFailed:
+			return err
+		case <-ctx.Done():
+			slog.Info("Shutting down mqtt-topic-remapper")
+			// Stop receiving new messages and let the in-flight publishes
+			// complete before disconnecting, so none are lost on restarts.
+			if topics := subscriptions(remaps.Load().remaps); len(topics) > 0 {
+				froms := make([]string, 0, len(topics))
+				for topic := range topics {
+					froms = append(froms, topic)
+				}
+				client.Unsubscribe(froms...).WaitTimeout(config.DrainTimeout)
+			}
+			stopStaleWatchers(config.Remaps)
+			for _, remap := range remaps.Load().remaps {
+				if remap.debouncer != nil {
+					remap.debouncer.flush()
+				}
+			}
+			// After the debouncers, whose publishes may be delayed too.
+			for _, remap := range remaps.Load().remaps {
+				if remap.delayer == nil {
+					continue
+				}
+				if config.DelayShutdown == delayShutdownDrop {
+					if dropped := remap.delayer.drop(); dropped > 0 {
+						remap.logger().Warn("Dropping delayed messages on shutdown", "from", remap.From, "messages", dropped)
+						// The delayed messages don't keep their source topic.
+						messagesDropped.WithLabelValues(remap.From, dropShutdown).Add(float64(dropped))
+					}
+				} else {
+					remap.delayer.flush()
+				}
+			}
+			for _, batch := range config.Batches {
+				batch.stop()
+			}
+			for _, merge := range config.Merges {
+				merge.stop()
+			}
+			removeDiscovery(publishBatch, config.Remaps, config.DiscoveryPrefix, nil)
+			if !buffer.drain(config.DrainTimeout) {
+				slog.Warn("Timed out waiting for in-flight publishes", "drain_timeout", config.DrainTimeout)
+			}
+			if config.WillTopic != "" && !flags.dryRun {
+				// The broker doesn't publish the will on a clean disconnect.
+				publisher.Publish(config.WillTopic, config.WillQoS, config.WillRetained, config.WillPayload).WaitTimeout(time.Second)
+			}
+			if config.StatusTopic != "" && !flags.dryRun {
+				publishStatus(publisher, config, config.StatusOffline)
+			}
+			return nil
+		}
+	}
+}
+
+// publishRemapped publishes the payload remapped from msg to destination,
+// unless it is a duplicate or within min_delta of the last value, adding the
+// timestamp if configured.
+func publishRemapped(client mqtt.Client, buffer *offlineBuffer, remap Remap, destination Destination, msg mqtt.Message, payload string, receivedAt time.Time, remappedAt time.Time) {
+	log := remap.logger()
+	to := destination.Topic
+	if remap.deduplicator != nil && remap.deduplicator.duplicate(to, payload) {
+		log.Debug("Dropping duplicate message", "from", msg.Topic(), "to", to)
+		countDropped(msg.Topic(), dropDuplicate)
+		return
+	}
+	if remap.deltaFilter != nil && remap.deltaFilter.suppressed(to, payload) {
+		log.Debug("Dropping message within min_delta of the last value", "from", msg.Topic(), "to", to, "payload", payload)
+		countDropped(msg.Topic(), dropMinDelta)
+		return
+	}
+
+	if remap.TimestampField != "" {
+		var ok bool
+		if payload, ok = remap.injectTimestamp(payload, remappedAt); !ok {
+			log.Debug("Not adding timestamp to non JSON object payload", "from", msg.Topic(), "to", to)
+		}
+	}
+	payload = remap.compress(payload)
+
+	var expiresAt time.Time
+	if remap.MessageExpiry > 0 {
+		expiresAt = remappedAt.Add(remap.MessageExpiry)
+	}
+
+	if buffer.dryRun {
+		log.Info("Dry run, not publishing remapped message", "from", msg.Topic(), "to", to, "payload", string(msg.Payload()), "remapped_payload", payload)
+		return
+	}
+	log.Debug("Converting message", "from", msg.Topic(), "to", to, "payload", string(msg.Payload()), "remapped_payload", payload, "payload_len", len(payload))
+	remapped := outgoingMessage{
+		topic:           to,
+		qos:             destination.pubQoS(remap),
+		retained:        destination.retained(remap, msg),
+		payload:         payload,
+		deadLetterTopic: remap.deadLetterTopic,
+		expiresAt:       expiresAt,
+		source:          msg.Topic(),
+		receivedAt:      receivedAt,
+		log:             log,
+	}
+	if remap.RepublishOnConnect {
+		buffer.lastValues.store(remapped)
+	}
+	if remap.reverseEchoes {
+		remap.echoes.expect(to, payload)
+		remapped.forgetEcho = func() { remap.echoes.forget(to, payload) }
+	}
+	buffer.publishAsync(client, remapped)
+	if remap.TimestampTopic != "" {
+		buffer.publishAsync(client, outgoingMessage{
+			topic:    to + remap.TimestampTopic,
+			qos:      destination.pubQoS(remap),
+			retained: destination.retained(remap, msg),
+			payload:  remap.timestampPayload(remappedAt),
+			log:      log,
+		})
+	}
+}
+
+// publish publishes msg. At QoS 1 and 2 it waits up to timeout for the broker
+// to acknowledge it, while QoS 0 messages are fire and forget and only fail if
+// they can't be sent at all (e.g. while disconnected).
+func publish(client mqtt.Client, msg outgoingMessage, timeout time.Duration) error {
+	token := client.Publish(msg.topic, msg.qos, msg.retained, msg.payload)
+	var err error
+	if msg.qos == 0 {
+		select {
+		case <-token.Done():
+			err = token.Error()
+		default:
+		}
+	} else if !token.WaitTimeout(timeout) {
+		err = fmt.Errorf("timed out after %s waiting for the publish to be acknowledged", timeout)
+	} else {
+		err = token.Error()
+	}
+	if err != nil {
+		publishErrors.WithLabelValues(msg.topic).Inc()
+		return err
+	}
+	messagesPublished.WithLabelValues(msg.topic).Inc()
+	observePublished(msg)
+	return nil
+}
+
+// subscriptions returns the QoS each topic must be subscribed with. Remaps
+// sharing a subscription get the highest QoS of them.
+func subscriptions(remaps []Remap) map[string]byte {
+	topics := make(map[string]byte, len(remaps))
+	for _, remap := range remaps {
+		topic := remap.subscription()
+		topics[topic] = max(topics[topic], remap.SubQoS)
+	}
+	return topics
+}
+
+// subscribedTo reports whether any of the subscriptions of remaps matches topic.
+func subscribedTo(remaps []Remap, topic string) bool {
+	for subscription := range subscriptions(remaps) {
+		if topicMatches(subscriptionFilter(subscription), topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadRemaps swaps the active remaps with newRemaps, updating the
+// subscriptions without dropping the connection. Removed topics are
+// unsubscribed before the swap and new ones are subscribed after it, so every
+// received message has a remap to handle it. The returned error joins those
+// of the new subscriptions that failed or timed out after timeout.
+func reloadRemaps(client mqtt.Client, remaps *atomic.Pointer[remapTable], oldRemaps []Remap, newRemaps []Remap, timeout time.Duration) error {
+	oldTopics := subscriptions(oldRemaps)
+	newTopics := subscriptions(newRemaps)
+
+	for topic := range oldTopics {
+		if _, ok := newTopics[topic]; !ok {
+			slog.Info("Unsubscribing removed remap", "from", topic)
+			client.Unsubscribe(topic).Wait()
+		}
+	}
+
+	table := newRemapTable(newRemaps)
+	remaps.Store(&table)
+
+	added := make(map[string]byte)
+	for topic, qos := range newTopics {
+		if oldQos, ok := oldTopics[topic]; !ok || oldQos != qos {
+			slog.Info("Subscribing new remap", "from", topic, "sub_qos", qos)
+			added[topic] = qos
+		}
+	}
+	return subscribe(client, added, timeout)
 }
@@ -0,0 +1,41 @@
+package main
+
+import "fmt"
+
+// resolveMappings merges the value mappings set referenced by each remap use
+// into its ValueMappings, the inline mappings taking precedence. The remaps
+// get their own copy so the env expansion and bidirectional inversion never
+// change a set shared with other remaps.
+func (c *Config) resolveMappings() []error {
+	var errs []error
+	for i := range c.Remaps {
+		if err := c.useMappings(&c.Remaps[i], c.Remaps[i].From); err != nil {
+			errs = append(errs, err)
+		}
+		for j := range c.Remaps[i].Pipeline {
+			if err := c.useMappings(&c.Remaps[i].Pipeline[j], fmt.Sprintf("%s pipeline step %d", c.Remaps[i].From, j+1)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+func (c *Config) useMappings(remap *Remap, from string) error {
+	if remap.Use == "" {
+		return nil
+	}
+	set, ok := c.Mappings[remap.Use]
+	if !ok {
+		return fmt.Errorf("remap from %s: unknown mappings %s", from, remap.Use)
+	}
+	merged := make(map[string]string, len(set)+len(remap.ValueMappings))
+	for from, to := range set {
+		merged[from] = to
+	}
+	for from, to := range remap.ValueMappings {
+		merged[from] = to
+	}
+	remap.ValueMappings = merged
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Merge is a named group combining the latest message of each remap
+// referencing it into a single JSON object, keyed by each remap's
+// merge_field. The object is published to To, which supports the {1}
+// placeholders of the remaps' from so that each device gets its own object,
+// whenever a value is updated or, with Interval, at most once per interval.
+// With Wait nothing is published until every one of Fields has been seen.
+type Merge struct {
+	Name     string        `toml:"name"`
+	To       string        `toml:"to"`
+	Fields   []string      `toml:"fields"`
+	Wait     bool          `toml:"wait"`
+	Interval time.Duration `toml:"interval"`
+	PubQoS   byte          `toml:"pub_qos"`
+	Retained bool          `toml:"retained"`
+
+	merger *merger
+}
+
+type merger struct {
+	merge Merge
+	mu    sync.Mutex
+	// documents holds the latest values by resolved destination topic, and
+	// updated the topics of the documents updated since the last interval.
+	documents map[string]map[string]any
+	updated   map[string]bool
+	publish   func(outgoingMessage)
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// validate returns every problem found in the merge.
+func (m Merge) validate() error {
+	var errs []error
+	if m.Name == "" {
+		errs = append(errs, fmt.Errorf("merge to %s: missing name", m.To))
+	}
+	if m.To == "" {
+		errs = append(errs, fmt.Errorf("merge %s: missing to", m.Name))
+	}
+	if m.Wait && len(m.Fields) == 0 {
+		errs = append(errs, fmt.Errorf("merge %s: wait requires the fields to wait for", m.Name))
+	}
+	if m.Interval < 0 {
+		errs = append(errs, fmt.Errorf("merge %s: invalid interval %s (must be positive)", m.Name, m.Interval))
+	}
+	if m.PubQoS > 2 {
+		errs = append(errs, fmt.Errorf("merge %s: invalid pub_qos %d (must be 0, 1 or 2)", m.Name, m.PubQoS))
+	}
+	return errors.Join(errs...)
+}
+
+func (m *Merge) compile() {
+	m.merger = &merger{merge: *m, documents: make(map[string]map[string]any), updated: make(map[string]bool)}
+}
+
+// update sets field to payload in the document of the destination topic
+// resolved with captures, publishing it unless it is published on an
+// interval. JSON payloads are stored decoded so they are nested in the
+// document instead of quoted.
+func (m *merger) update(captures []string, field string, payload string) {
+	var value any = payload
+	if decoded, err := decodeJSON(payload); err == nil {
+		value = decoded
+	}
+	to := expandTopic(m.merge.To, captures)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	document, ok := m.documents[to]
+	if !ok {
+		document = make(map[string]any)
+		m.documents[to] = document
+	}
+	document[field] = value
+	if m.merge.Interval > 0 {
+		m.updated[to] = true
+		return
+	}
+	m.publishDocument(to)
+}
+
+// publishDocument publishes the document of to, unless some of the fields
+// waited for are still missing. It must be called with the lock held, which
+// keeps the documents of each topic published in order.
+func (m *merger) publishDocument(to string) {
+	if m.publish == nil {
+		return
+	}
+	document := m.documents[to]
+	if m.merge.Wait {
+		for _, field := range m.merge.Fields {
+			if _, ok := document[field]; !ok {
+				slog.Debug("Waiting for merge field", "merge", m.merge.Name, "to", to, "field", field)
+				return
+			}
+		}
+	}
+	payload, err := encodeJSON(document)
+	if err != nil {
+		slog.Error("Error encoding merge", "merge", m.merge.Name, "to", to, "error", err)
+		return
+	}
+	slog.Debug("Publishing merge", "merge", m.merge.Name, "to", to, "fields", len(document))
+	m.publish(outgoingMessage{topic: to, qos: m.merge.PubQoS, retained: m.merge.Retained, payload: payload})
+}
+
+// publishUpdated publishes the documents updated since the last interval.
+func (m *merger) publishUpdated() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for to := range m.updated {
+		m.publishDocument(to)
+		delete(m.updated, to)
+	}
+}
+
+// start publishes the merge through publish, on every interval if it has one,
+// until stop is called.
+func (m Merge) start(publish func(outgoingMessage)) {
+	m.merger.mu.Lock()
+	m.merger.publish = publish
+	m.merger.mu.Unlock()
+	if m.Interval == 0 {
+		return
+	}
+	m.merger.stop = make(chan struct{})
+	m.merger.done = make(chan struct{})
+	go func() {
+		defer close(m.merger.done)
+		ticker := time.NewTicker(m.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.merger.publishUpdated()
+			case <-m.merger.stop:
+				m.merger.publishUpdated()
+				return
+			}
+		}
+	}()
+}
+
+// stop stops publishing the merge, publishing the documents updated since
+// the last interval.
+func (m Merge) stop() {
+	if m.Interval > 0 {
+		close(m.merger.stop)
+		<-m.merger.done
+	}
+	m.merger.mu.Lock()
+	m.merger.publish = nil
+	m.merger.mu.Unlock()
+}
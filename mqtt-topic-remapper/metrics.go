@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_topic_remapper_messages_received_total",
+		Help: "Number of messages received, by source topic.",
+	}, []string{"topic"})
+	messagesPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_topic_remapper_messages_published_total",
+		Help: "Number of messages published, by destination topic.",
+	}, []string{"topic"})
+	publishErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_topic_remapper_publish_errors_total",
+		Help: "Number of failed publishes, by destination topic.",
+	}, []string{"topic"})
+	messagesFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_topic_remapper_messages_filtered_total",
+		Help: "Number of messages dropped by the allow/deny filters, by source topic.",
+	}, []string{"topic"})
+	messagesOversized = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_topic_remapper_messages_oversized_total",
+		Help: "Number of messages dropped for exceeding max_payload_size, by source topic.",
+	}, []string{"topic"})
+	messagesRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_topic_remapper_messages_rate_limited_total",
+		Help: "Number of messages dropped by the rate limit, by destination topic.",
+	}, []string{"topic"})
+	messagesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_topic_remapper_messages_dropped_total",
+		Help: "Number of messages dropped, by source topic and reason (see the drop* constants).",
+	}, []string{"topic", "reason"})
+	messagesExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_topic_remapper_messages_expired_total",
+		Help: "Number of messages dropped because their message_expiry elapsed before they were published, by destination topic.",
+	}, []string{"topic"})
+	thresholdFlapsSuppressed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_topic_remapper_threshold_flaps_suppressed_total",
+		Help: "Number of messages whose threshold state was kept by the hysteresis, by remap name (or its from if unnamed).",
+	}, []string{"remap"})
+	remapDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mqtt_topic_remapper_remap_duration_seconds",
+		Help:    "Time spent remapping a message.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 8),
+	})
+	processingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mqtt_topic_remapper_processing_duration_seconds",
+		Help:    "Time from receiving a message to its remapped message being published (including any debounce, delay and time queued), by source topic.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"topic"})
+	messagesPerSecond = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_topic_remapper_messages_per_second",
+		Help: "Number of messages published per second, averaged over the last throughput interval.",
+	})
+)
+
+// The reasons messages are dropped for, the reason label of messagesDropped.
+// Messages published by the remapper itself, such as batches, have an empty
+// source topic.
+const (
+	dropNoRemap         = "no_remap"
+	dropOversized       = "oversized"
+	dropUnmatched       = "unmatched"
+	dropFiltered        = "filtered"
+	dropConditionNotMet = "condition_not_met"
+	dropTransformError  = "transform_error"
+	dropNoRoute         = "no_route"
+	dropRateLimited     = "rate_limited"
+	dropDuplicate       = "duplicate"
+	dropMinDelta        = "min_delta"
+	dropDebounced       = "debounced"
+	dropExpired         = "expired"
+	dropQueueFull       = "queue_full"
+	dropBufferFull      = "buffer_full"
+	dropDelayFull       = "delay_full"
+	dropPublishError    = "publish_error"
+	dropShutdown        = "shutdown"
+)
+
+// countDropped counts a message received on topic dropped for reason.
+func countDropped(topic string, reason string) {
+	messagesDropped.WithLabelValues(topic, reason).Inc()
+}
+
+// throughputInterval is how often messagesPerSecond is updated.
+const throughputInterval = 10 * time.Second
+
+var (
+	// metricsEnabled is set while the metrics are served, so that the
+	// processing metrics cost nothing when they aren't.
+	metricsEnabled atomic.Bool
+	// published counts the messages published for messagesPerSecond.
+	published atomic.Uint64
+)
+
+// observePublished updates the processing metrics of msg once published.
+func observePublished(msg outgoingMessage) {
+	if !metricsEnabled.Load() {
+		return
+	}
+	published.Add(1)
+	if !msg.receivedAt.IsZero() {
+		processingDuration.WithLabelValues(msg.source).Observe(time.Since(msg.receivedAt).Seconds())
+	}
+}
+
+// trackThroughput updates messagesPerSecond every throughput interval until
+// stop is closed.
+func trackThroughput(stop <-chan struct{}) {
+	ticker := time.NewTicker(throughputInterval)
+	defer ticker.Stop()
+	last := published.Load()
+	for {
+		select {
+		case <-ticker.C:
+			current := published.Load()
+			messagesPerSecond.Set(float64(current-last) / throughputInterval.Seconds())
+			last = current
+		case <-stop:
+			return
+		}
+	}
+}
+
+// startMetricsServer serves the Prometheus metrics on addr in the background.
+func startMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	metricsEnabled.Store(true)
+	stop := make(chan struct{})
+	server.RegisterOnShutdown(func() {
+		metricsEnabled.Store(false)
+		close(stop)
+	})
+	go trackThroughput(stop)
+	go func() {
+		slog.Info("Serving metrics", "addr", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error serving metrics", "error", err)
+		}
+	}()
+
+	return server
+}
+
+func stopHttpServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Error shutting down HTTP server", "addr", server.Addr, "error", err)
+	}
+}
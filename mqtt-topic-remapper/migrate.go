@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// currentConfigVersion is the config version written by -migrate. Version 2
+// replaces the flat message map of substring replacements, whose order isn't
+// visible in the config, with the ordered replace list. Version 1 is the
+// schema of the configs without a version.
+const currentConfigVersion = 2
+
+// validateVersion returns the problems found in the config decoded from
+// file for its version, warning about the keys deprecated since version 1.
+func (c Config) validateVersion(file string) []error {
+	version := c.Version
+	if version == 0 {
+		version = 1
+	}
+	if version < 1 || version > currentConfigVersion {
+		return []error{fmt.Errorf("%s: unsupported config version %d (must be between 1 and %d)", file, c.Version, currentConfigVersion)}
+	}
+
+	var remaps []string
+	for _, remap := range c.Remaps {
+		if remap.substringMessage() {
+			remaps = append(remaps, remap.From)
+		}
+	}
+	if len(remaps) == 0 {
+		return nil
+	}
+	if version == 1 {
+		slog.Warn("Config uses message for substring replacements, deprecated since config version 2 in favour of replace, run with -migrate to convert it", "file", file, "remaps", remaps)
+		return nil
+	}
+	errs := make([]error, len(remaps))
+	for i, from := range remaps {
+		errs[i] = fmt.Errorf("remap from %s: message can't be used for substring replacements since config version 2, use replace instead", from)
+	}
+	return errs
+}
+
+// substringMessage reports whether r, or one of its pipeline steps, uses the
+// message map for substring replacements, which replace supersedes. The map
+// is still used for the exact, regex and glob matches, to be inverted by
+// bidirectional remaps and to override the mappings of use.
+func (r Remap) substringMessage() bool {
+	for _, step := range r.Pipeline {
+		if step.substringMessage() {
+			return true
+		}
+	}
+	return len(r.ValueMappings) > 0 && r.Match != matchExact && !r.Regex && !r.Glob && !r.Bidirectional && r.Use == ""
+}
+
+// warnUndecoded logs the keys of file that don't match any config option,
+// which are otherwise silently ignored. The destination tables are decoded by
+// Destinations, which rejects their unknown keys itself.
+func warnUndecoded(file string, meta toml.MetaData) {
+	for _, key := range meta.Undecoded() {
+		if len(key) > 2 && key[0] == "remap" && key[1] == "to" {
+			continue
+		}
+		slog.Warn("Unknown config key, ignoring it", "file", file, "key", key.String())
+	}
+}
+
+// migrateConfig writes the config file migrated to the current version to w
+// as TOML. The comments of the file are lost.
+func migrateConfig(w io.Writer, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var document map[string]any
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &document)
+	case ".json":
+		err = json.Unmarshal(data, &document)
+	default:
+		err = toml.Unmarshal(data, &document)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	normalized, err := normalizeDocument(document, "")
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	document = normalized.(map[string]any)
+
+	if version, ok := document["version"].(int64); ok && version >= currentConfigVersion {
+		return fmt.Errorf("%s is already config version %d", file, version)
+	}
+	for _, remap := range tables(document["remap"]) {
+		if err := migrateRemap(remap, fmt.Sprint(remap["from"])); err != nil {
+			return err
+		}
+	}
+	document["version"] = int64(currentConfigVersion)
+
+	fmt.Fprintf(w, "# Migrated from %s to config version %d\n", file, currentConfigVersion)
+	return toml.NewEncoder(w).Encode(document)
+}
+
+// migrateRemap converts the message map of the substring replacements of a
+// remap table, and of its pipeline steps, into the equivalent replace list.
+func migrateRemap(remap map[string]any, from string) error {
+	for i, step := range tables(remap["pipeline"]) {
+		if err := migrateRemap(step, fmt.Sprintf("%s pipeline step %d", from, i+1)); err != nil {
+			return err
+		}
+	}
+	message, ok := remap["message"].(map[string]any)
+	if !ok || remap["match"] == matchExact || remap["regex"] == true || remap["glob"] == true || remap["bidirectional"] == true || remap["use"] != nil {
+		return nil
+	}
+	mappings := make(map[string]string, len(message))
+	for key, value := range message {
+		mappings[key] = fmt.Sprint(value)
+	}
+	sequential := sequentialReplacement(mappings)
+	if remap["case_insensitive"] == true {
+		// The keys then also overlap other keys and values differing by case.
+		folded := make(map[string]string, len(mappings))
+		for key, value := range mappings {
+			folded[strings.ToLower(key)] = strings.ToLower(value)
+		}
+		sequential = sequential && len(folded) == len(mappings) && sequentialReplacement(folded)
+	}
+	if !sequential {
+		return fmt.Errorf("remap from %s: message can't be converted to replace automatically since applying its mappings one after the other could give another result, rewrite it as replace in the order they must be applied", from)
+	}
+	replace := make([]map[string]any, 0, len(mappings))
+	for _, key := range sortedKeys(mappings) {
+		replace = append(replace, map[string]any{"from": key, "to": mappings[key]})
+	}
+	remap["replace"] = replace
+	delete(remap, "message")
+	return nil
+}
+
+// sequentialReplacement reports whether applying mappings one after the other
+// gives the same result as replacing them all in a single pass, which is the
+// case when no key overlaps another key or a value, so that no replacement
+// can create or break a match of another.
+func sequentialReplacement(mappings map[string]string) bool {
+	for key := range mappings {
+		for other, value := range mappings {
+			if other != key && (strings.Contains(key, other) || overlaps(key, other)) {
+				return false
+			}
+			if strings.Contains(value, key) || strings.Contains(key, value) || overlaps(key, value) || overlaps(value, key) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// overlaps reports whether a proper suffix of a is a prefix of b.
+func overlaps(a string, b string) bool {
+	for i := 1; i < len(a); i++ {
+		if strings.HasPrefix(b, a[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// tables returns value as a list of tables, as decoded either from TOML
+// arrays of tables or from YAML and JSON lists.
+func tables(value any) []map[string]any {
+	switch value := value.(type) {
+	case []map[string]any:
+		return value
+	case []any:
+		var tables []map[string]any
+		for _, item := range value {
+			if table, ok := item.(map[string]any); ok {
+				tables = append(tables, table)
+			}
+		}
+		return tables
+	}
+	return nil
+}
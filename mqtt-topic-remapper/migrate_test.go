@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrateSubstringMappings(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		// ok is whether the message can be converted to replace.
+		ok bool
+	}{
+		{name: "disjoint", message: `{ on = "1", off = "0" }`, ok: true},
+		{name: "overlapping keys", message: `{ a = "b", b = "c" }`},
+		{name: "keys differing by case", message: `{ A = "x", ab = "y" }`},
+		{name: "value differing by case", message: `{ a = "B", b = "c" }`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := `
+[[remap]]
+from = "a"
+to = "b"
+case_insensitive = true
+message = ` + test.message
+			var migrated strings.Builder
+			err := migrateConfig(&migrated, writeTestConfig(t, config))
+			if !test.ok {
+				if err == nil || !strings.Contains(err.Error(), "can't be converted") {
+					t.Fatalf("got error %v, want the message refused:\n%s", err, migrated.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, after := testRemap(t, config), testRemap(t, migrated.String())
+			for _, payload := range []string{"On", "OFF", "on and off"} {
+				want, err := before.remapPayload(before.From, nil, payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := after.remapPayload(after.From, nil, payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("%q: got %q after migrating, want %q", payload, got, want)
+				}
+			}
+		})
+	}
+}
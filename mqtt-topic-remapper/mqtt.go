@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Broker is the connection to an MQTT broker. URI is a comma separated list
+// of brokers which are tried in order on every connection attempt, so the
+// first one is preferred and the others are used as failover. A single broker
+// can be given as Host, Port, Scheme and Path instead, see Broker.uri.
+//
+// TLSCert and TLSKey are the paths of the PEM client certificate and private
+// key presented to TLS brokers requiring mutual TLS. An encrypted key is
+// decrypted with the passphrase in the env var named by
+// TLSKeyPassphraseEnv (default MQTT_TLS_KEY_PASSPHRASE).
+type Broker struct {
+	URI                 string `toml:"uri"`
+	Host                string `toml:"host"`
+	Port                int    `toml:"port"`
+	Scheme              string `toml:"scheme"`
+	Path                string `toml:"path"`
+	Username            string `toml:"username"`
+	Password            string `toml:"password"`
+	ClientID            string `toml:"client_id"`
+	TLSCert             string `toml:"tls_cert"`
+	TLSKey              string `toml:"tls_key"`
+	TLSKeyPassphraseEnv string `toml:"tls_key_passphrase_env"`
+}
+
+const defaultTLSKeyPassphraseEnv = "MQTT_TLS_KEY_PASSPHRASE"
+
+// brokerSchemes are the supported broker URI schemes and their default port,
+// 0 for WebSocket brokers whose URL defaults to the HTTP port.
+var brokerSchemes = map[string]int{
+	"tcp": 1883, "mqtt": 1883,
+	"ssl": 8883, "tls": 8883, "mqtts": 8883,
+	"ws": 0, "wss": 0,
+}
+
+// validate returns the problems found in the broker table name.
+func (b Broker) validate(name string) []error {
+	var errs []error
+	if b.URI != "" && (b.Host != "" || b.Port != 0 || b.Scheme != "" || b.Path != "") {
+		errs = append(errs, fmt.Errorf("[%s]: uri can't be used together with host, port, scheme and path", name))
+	}
+	if b.Host == "" && (b.Port != 0 || b.Scheme != "" || b.Path != "") {
+		errs = append(errs, fmt.Errorf("[%s]: port, scheme and path require host", name))
+	}
+	if b.Port < 0 || b.Port > 65535 {
+		errs = append(errs, fmt.Errorf("[%s]: invalid port %d (must be between 1 and 65535)", name, b.Port))
+	}
+	if _, ok := brokerSchemes[b.Scheme]; b.Scheme != "" && !ok {
+		errs = append(errs, fmt.Errorf("[%s]: unsupported scheme %s (must be tcp, mqtt, ssl, tls, mqtts, ws or wss)", name, b.Scheme))
+	}
+	if b.Path != "" && b.Scheme != "ws" && b.Scheme != "wss" {
+		errs = append(errs, fmt.Errorf("[%s]: path can only be used with the ws and wss schemes", name))
+	}
+	if (b.TLSCert == "") != (b.TLSKey == "") {
+		errs = append(errs, fmt.Errorf("[%s]: tls_cert and tls_key must be set together", name))
+	}
+	if b.TLSKeyPassphraseEnv != "" && b.TLSKey == "" {
+		errs = append(errs, fmt.Errorf("[%s]: tls_key_passphrase_env requires tls_key", name))
+	}
+	return errs
+}
+
+// uri returns the URI of the broker, assembled from Host, Port (default
+// 1883, or 8883 for TLS), Scheme (default tcp) and Path unless URI is set.
+func (b Broker) uri() string {
+	if b.URI != "" || b.Host == "" {
+		return b.URI
+	}
+	scheme := b.Scheme
+	if scheme == "" {
+		scheme = "tcp"
+	}
+	port := b.Port
+	if port == 0 {
+		port = brokerSchemes[scheme]
+	}
+	address := b.Host
+	if port != 0 {
+		address = net.JoinHostPort(b.Host, strconv.Itoa(port))
+	} else if strings.Contains(b.Host, ":") {
+		address = "[" + b.Host + "]"
+	}
+	uri := scheme + "://" + address
+	if b.Path != "" {
+		uri += "/" + strings.TrimPrefix(b.Path, "/")
+	}
+	return uri
+}
+
+// sourceBroker returns the broker the remaps subscribe to: the [source] table
+// of the config, overridden by the MQTT_SERVER_URI, MQTT_USERNAME,
+// MQTT_PASSWORD, MQTT_CLIENT_ID, MQTT_TLS_CERT and MQTT_TLS_KEY env vars,
+// themselves overridden by the
+// fields set in flags (the -broker, -username and -password flags), and
+// falling back to client_id.
+func (c Config) sourceBroker(flags Broker) Broker {
+	var broker Broker
+	if c.Source != nil {
+		broker = *c.Source
+	}
+	for env, value := range map[string]*string{
+		"MQTT_SERVER_URI": &broker.URI,
+		"MQTT_USERNAME":   &broker.Username,
+		"MQTT_PASSWORD":   &broker.Password,
+		"MQTT_CLIENT_ID":  &broker.ClientID,
+		"MQTT_TLS_CERT":   &broker.TLSCert,
+		"MQTT_TLS_KEY":    &broker.TLSKey,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*value = v
+		}
+	}
+	if flags.URI != "" {
+		broker.URI = flags.URI
+	}
+	if flags.Username != "" {
+		broker.Username = flags.Username
+	}
+	if flags.Password != "" {
+		broker.Password = flags.Password
+	}
+	if broker.ClientID == "" {
+		broker.ClientID = c.ClientID
+	}
+	return broker
+}
+
+// createClientOptions creates the options of the client connecting to broker.
+func createClientOptions(broker Broker, config Config) (*mqtt.ClientOptions, error) {
+	opts := mqtt.NewClientOptions()
+	useTLS := false
+	for _, brokerUri := range strings.Split(broker.uri(), ",") {
+		brokerUri = strings.TrimSpace(brokerUri)
+		if brokerUri == "" {
+			continue
+		}
+		scheme, brokerUrl := brokerURL(brokerUri, os.Getenv("MQTT_SERVER_SCHEME"), os.Getenv("MQTT_SERVER_PATH"))
+		switch scheme {
+		case "tcp", "mqtt", "ws":
+		case "ssl", "tls", "mqtts", "wss":
+			useTLS = true
+		default:
+			return nil, fmt.Errorf("unsupported broker scheme %s", scheme)
+		}
+		opts.AddBroker(brokerUrl)
+	}
+	if len(opts.Servers) == 0 {
+		return nil, fmt.Errorf("no broker configured, set -broker or MQTT_SERVER_URI")
+	}
+
+	clientID := broker.ClientID
+	cleanSession := config.CleanSession == nil || *config.CleanSession
+	if clientID == "" {
+		clientID = generateClientID()
+		if !cleanSession {
+			slog.Warn("clean_session is disabled but the client ID is generated, the persistent session won't be resumed after a restart", "client_id", clientID)
+		}
+	}
+	slog.Info("Using MQTT client ID", "client_id", clientID, "clean_session", cleanSession)
+	opts.SetClientID(clientID)
+	opts.SetCleanSession(cleanSession)
+	opts.SetUsername(broker.Username)
+	opts.SetPassword(broker.Password)
+	opts.SetProtocolVersion(config.ProtocolVersion)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectTimeout(config.ConnectTimeout)
+	opts.SetKeepAlive(config.KeepAlive)
+
+	if (broker.TLSCert != "" || broker.TLSKey != "") && !useTLS {
+		return nil, fmt.Errorf("a TLS client certificate is configured but the broker scheme isn't ssl, tls, mqtts or wss")
+	}
+	if useTLS {
+		tlsConfig, err := createTLSConfig(os.Getenv("MQTT_CA_CERT"), os.Getenv("MQTT_TLS_INSECURE"))
+		if err != nil {
+			return nil, err
+		}
+		if broker.TLSCert != "" || broker.TLSKey != "" {
+			certificate, err := loadClientCertificate(broker)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{certificate}
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	return opts, nil
+}
+
+// trackBroker remembers the broker each connection attempt of the client is
+// made to, since the client doesn't expose which of its brokers it connected
+// to.
+func trackBroker(opts *mqtt.ClientOptions) *atomic.Value {
+	var broker atomic.Value
+	opts.SetConnectionAttemptHandler(func(attempted *url.URL, tlsConfig *tls.Config) *tls.Config {
+		slog.Debug("Connecting to MQTT server", "broker", attempted.Redacted())
+		broker.Store(attempted.Redacted())
+		return tlsConfig
+	})
+	return &broker
+}
+
+// brokerURL builds the broker URL from the broker URI, which may already
+// contain a scheme (e.g. "wss://broker.example/mqtt"). Otherwise scheme
+// (default tcp) is prepended and, for WebSocket brokers, path is appended since
+// the upgrade request needs the full path. It returns the scheme in use too.
+func brokerURL(uri string, scheme string, path string) (string, string) {
+	if before, _, ok := strings.Cut(uri, "://"); ok {
+		return before, uri
+	}
+	if scheme == "" {
+		scheme = "tcp"
+	}
+	url := fmt.Sprintf("%s://%s", scheme, uri)
+	if (scheme == "ws" || scheme == "wss") && path != "" {
+		url += "/" + strings.TrimPrefix(path, "/")
+	}
+	return scheme, url
+}
+
+// generateClientID returns a client ID unique to this process, so multiple
+// instances don't kick each other off the broker.
+func generateClientID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("mqtt-topic-remapper-%s-%s", hostname, hex.EncodeToString(suffix))
+}
+
+// createTLSConfig builds the TLS configuration used for ssl:// and tls:// brokers.
+// If caCertPath is empty the system certificate pool is used.
+func createTLSConfig(caCertPath string, insecure string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if caCertPath != "" {
+		caCert, err := os.ReadFile(caCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid certificates found in %s", caCertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if insecure != "" {
+		skipVerify, err := strconv.ParseBool(insecure)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MQTT_TLS_INSECURE value %s: %s", insecure, err)
+		}
+		tlsConfig.InsecureSkipVerify = skipVerify
+	}
+
+	return tlsConfig, nil
+}
+
+// loadClientCertificate loads the TLS client certificate and private key of
+// broker, decrypting the key if it is encrypted, and checks that they match.
+func loadClientCertificate(broker Broker) (tls.Certificate, error) {
+	if broker.TLSCert == "" || broker.TLSKey == "" {
+		return tls.Certificate{}, fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	certPEM, err := os.ReadFile(broker.TLSCert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to read TLS client certificate: %s", err)
+	}
+	keyPEM, err := os.ReadFile(broker.TLSKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to read TLS client key: %s", err)
+	}
+	if keyPEM, err = decryptKey(keyPEM, broker); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to decrypt TLS client key %s: %s", broker.TLSKey, err)
+	}
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid TLS client certificate %s or key %s: %s", broker.TLSCert, broker.TLSKey, err)
+	}
+	return certificate, nil
+}
+
+// decryptKey returns the PEM private key keyPEM decrypted with the passphrase
+// of broker if it is encrypted, and unchanged otherwise. Only the legacy PEM
+// encryption (a "Proc-Type: 4,ENCRYPTED" header) is supported by the
+// standard library, encrypted PKCS #8 keys have to be converted.
+func decryptKey(keyPEM []byte, broker Broker) ([]byte, error) {
+	var decrypted []byte
+	for rest := keyPEM; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			return nil, fmt.Errorf("encrypted PKCS #8 keys aren't supported, convert it to the legacy PEM encryption, e.g. with openssl pkey -aes256 -traditional")
+		}
+		// The legacy PEM encryption functions are deprecated as insecure,
+		// but it is what openssl writes for encrypted traditional keys.
+		if !x509.IsEncryptedPEMBlock(block) {
+			decrypted = append(decrypted, pem.EncodeToMemory(block)...)
+			continue
+		}
+		env := broker.TLSKeyPassphraseEnv
+		if env == "" {
+			env = defaultTLSKeyPassphraseEnv
+		}
+		passphrase, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("the key is encrypted but %s isn't set", env)
+		}
+		der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+		if err != nil {
+			return nil, err
+		}
+		decrypted = append(decrypted, pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})...)
+	}
+	return decrypted, nil
+}
+
+// connect connects client to the broker, retrying with an exponential backoff
+// until it succeeds, or the connect retries or max elapsed time are exceeded
+// (-1 and 0 respectively retry forever).
+// Each attempt is bounded by the connect timeout set in the client options.
+func connect(ctx context.Context, client mqtt.Client, config Config) error {
+	start := time.Now()
+	interval := config.ConnectInitialInterval
+	retries := *config.ConnectRetries
+	for retry := 1; ; retry++ {
+		token := client.Connect()
+		select {
+		case <-token.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err := token.Error()
+		if err == nil {
+			return nil
+		}
+
+		if retries >= 0 && retry > retries {
+			return fmt.Errorf("failed to connect to MQTT server after %d attempts: %s", retry, err)
+		}
+		if config.ConnectMaxElapsedTime != 0 && time.Since(start)+interval > config.ConnectMaxElapsedTime {
+			return fmt.Errorf("failed to connect to MQTT server: %s", err)
+		}
+		if retries >= 0 {
+			slog.Warn("Failed to connect to MQTT server, retrying", "error", err, "retry_in", interval, "retry", retry, "remaining", retries-retry)
+		} else {
+			slog.Warn("Failed to connect to MQTT server, retrying", "error", err, "retry_in", interval, "retry", retry)
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		interval = min(interval*2, config.ConnectMaxInterval)
+	}
+}
+
+// publishStatus publishes status retained to the status topic, waiting for
+// the broker to acknowledge it at most the publish timeout.
+func publishStatus(client mqtt.Client, config Config, status string) {
+	token := client.Publish(config.StatusTopic, 1, true, status)
+	if !token.WaitTimeout(config.PublishTimeout) {
+		slog.Warn("Timed out publishing status", "topic", config.StatusTopic, "status", status)
+	} else if err := token.Error(); err != nil {
+		slog.Warn("Error publishing status", "topic", config.StatusTopic, "status", status, "error", err)
+	}
+}
+
+// subscribe subscribes client to topics with their QoS, logging the
+// subscriptions that fail or aren't acknowledged within timeout, whose errors
+// are joined in the returned error.
+func subscribe(client mqtt.Client, topics map[string]byte, timeout time.Duration) error {
+	var errs []error
+	for topic, qos := range topics {
+		token := client.Subscribe(topic, qos, nil)
+		var err error
+		if token.WaitTimeout(timeout) {
+			err = subscribeError(token, topic)
+		} else {
+			err = fmt.Errorf("not acknowledged by the broker within %s", timeout)
+		}
+		if err != nil {
+			slog.Error("Error subscribing", "topic", topic, "sub_qos", qos, "error", err)
+			errs = append(errs, fmt.Errorf("subscribing to %s: %w", topic, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// subscribeError returns the error of the completed subscribe token for
+// topic. The broker grants QoS 0x80 (failure) instead of rejecting the
+// SUBSCRIBE when its ACL denies it, which the token doesn't report as an
+// error.
+func subscribeError(token mqtt.Token, topic string) error {
+	if err := token.Error(); err != nil {
+		return err
+	}
+	if subscribe, ok := token.(*mqtt.SubscribeToken); ok && subscribe.Result()[topic] > 2 {
+		return fmt.Errorf("refused by the broker, check its ACL")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// unacknowledgedClient is a client whose subscriptions are never
+// acknowledged by the broker.
+type unacknowledgedClient struct {
+	mqtt.Client
+}
+
+func (unacknowledgedClient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	return pendingToken{}
+}
+
+// pendingToken is a token that never completes.
+type pendingToken struct{}
+
+func (pendingToken) Wait() bool { select {} }
+func (pendingToken) WaitTimeout(timeout time.Duration) bool {
+	time.Sleep(timeout)
+	return false
+}
+func (pendingToken) Done() <-chan struct{} { return nil }
+func (pendingToken) Error() error          { return nil }
+
+func TestSubscribeTimeout(t *testing.T) {
+	err := subscribe(unacknowledgedClient{}, map[string]byte{"a": 1}, 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "not acknowledged") {
+		t.Errorf("got error %v, want the subscription timed out", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import "sync"
+
+// echoFilter remembers the payloads a remap published to a topic it is
+// subscribed to, its own source topic for passthrough remaps or the source
+// topic of its reverse for bidirectional ones, so the copies the broker sends
+// back to the subscription are recognised and not remapped again in an
+// endless loop.
+type echoFilter struct {
+	mu      sync.Mutex
+	pending map[echo]int
+}
+
+type echo struct {
+	topic   string
+	payload string
+}
+
+func newEchoFilter() *echoFilter {
+	return &echoFilter{pending: make(map[echo]int)}
+}
+
+// expect records that payload is about to be published to topic.
+func (f *echoFilter) expect(topic string, payload string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending[echo{topic, payload}]++
+}
+
+// consume reports whether a message received on topic is the echo of a
+// publish, forgetting it if so.
+func (f *echoFilter) consume(topic string, payload string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.forgetLocked(echo{topic, payload})
+}
+
+// forget undoes expect for a publish that was dropped instead.
+func (f *echoFilter) forget(topic string, payload string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.forgetLocked(echo{topic, payload})
+}
+
+func (f *echoFilter) forgetLocked(key echo) bool {
+	if f.pending[key] == 0 {
+		return false
+	}
+	if f.pending[key]--; f.pending[key] == 0 {
+		delete(f.pending, key)
+	}
+	return true
+}
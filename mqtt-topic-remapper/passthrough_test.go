@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestEchoFilter(t *testing.T) {
+	f := newEchoFilter()
+	f.expect("topic", "a")
+	f.expect("topic", "a")
+	if f.consume("topic", "b") || f.consume("other", "a") {
+		t.Error("consumed a message that wasn't expected")
+	}
+	if !f.consume("topic", "a") || !f.consume("topic", "a") {
+		t.Error("didn't consume the expected echoes")
+	}
+	if f.consume("topic", "a") {
+		t.Error("consumed more echoes than expected")
+	}
+}
+
+// echoMessage returns a message to topic whose echo f expects.
+func echoMessage(f *echoFilter, topic string, payload string) outgoingMessage {
+	f.expect(topic, payload)
+	return outgoingMessage{
+		topic:      topic,
+		payload:    payload,
+		forgetEcho: func() { f.forget(topic, payload) },
+	}
+}
+
+func TestDroppedMessagesForgetTheirEcho(t *testing.T) {
+	f := newEchoFilter()
+
+	// Buffered while disconnected, the first message is dropped when the
+	// second one doesn't fit.
+	buffer := newOfflineBuffer(Config{BufferSize: 1}, false)
+	buffer.publish(nil, echoMessage(f, "full", "a"))
+	buffer.publish(nil, echoMessage(f, "full", "b"))
+	if f.consume("full", "a") {
+		t.Error("expected the echo of the message dropped from the full offline buffer")
+	}
+	if !f.consume("full", "b") {
+		t.Error("forgot the echo of the buffered message")
+	}
+
+	// Published on shutdown.
+	buffer.drain(0)
+	buffer.publishAsync(nil, echoMessage(f, "shutdown", "a"))
+	if f.consume("shutdown", "a") {
+		t.Error("expected the echo of the message dropped on shutdown")
+	}
+
+	dryRun := newOfflineBuffer(Config{QueueSize: 1}, true)
+	dryRun.publishAsync(nil, echoMessage(f, "dry-run", "a"))
+	if f.consume("dry-run", "a") {
+		t.Error("expected the echo of the message not published in a dry run")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateStep validates the i-th step of the pipeline of the remap from
+// from. The step is labelled with its position first, so that the errors and
+// logs about it can be told apart from those about the remap.
+func (r *Remap) validateStep(from string, i int) error {
+	r.From = fmt.Sprintf("%s pipeline step %d", from, i+1)
+	r.pipelineStep = true
+	if options := r.routingOptions(); len(options) > 0 {
+		return fmt.Errorf("remap from %s: %s can't be used in a pipeline step", r.From, strings.Join(options, ", "))
+	}
+	return r.validate()
+}
+
+// routingOptions returns the names of the options set on r that decide where
+// and how messages are received and published, rather than transforming the
+// payload.
+func (r Remap) routingOptions() []string {
+	var options []string
+	add := func(name string, set bool) {
+		if set {
+			options = append(options, name)
+		}
+	}
+	add("to, split or routes", len(r.To) > 0 || len(r.Split) > 0 || len(r.Routes) > 0)
+	add("from_regex, subscribe or shared_group", r.FromRegex || r.Subscribe != "" || r.SharedGroup != "")
+	add("sub_qos or pub_qos", r.SubQoS != 0 || r.PubQoS != 0)
+	add("retained or retain_from_source", r.Retained || r.RetainFromSource)
+	add("bidirectional", r.Bidirectional)
+	add("strip_prefix or add_prefix", r.StripPrefix != "" || r.AddPrefix != "")
+	add("dead_letter_topic", r.DeadLetterTopic != "")
+	add("rate_limit", r.RateLimit != 0 || r.RateLimitInterval != 0)
+	add("dedupe", r.Dedupe || r.DedupeMaxAge != 0)
+	add("min_delta", r.MinDelta != nil || r.MinDeltaMaxAge != 0)
+	add("stale_after", r.StaleAfter != 0 || r.StaleTopic != "" || r.StalePayload != nil || r.FreshPayload != nil)
+	add("debounce or delay", r.Debounce != 0 || r.Delay != 0)
+	add("batch", r.Batch != "" || r.BatchKey != "")
+	add("merge", r.Merge != "" || r.MergeField != "")
+	add("passthrough", r.Passthrough)
+	add("else_to", r.ElseTo != "")
+	add("timestamp_field or timestamp_topic", r.TimestampField != "" || r.TimestampTopic != "" || r.TimestampFormat != "")
+	add("message_expiry", r.MessageExpiry != 0)
+	add("binary", r.Binary)
+	add("enabled", r.Enabled != nil)
+	add("max_payload_size", r.MaxPayloadSize != 0)
+	add("pipeline", len(r.Pipeline) > 0)
+	add("discovery", r.Discovery != nil)
+	add("decompress or compress", r.Decompress != "" || r.Compress != "")
+	add("base64_encode or base64_decode", r.Base64Encode || r.Base64Decode)
+	add("republish_on_connect", r.RepublishOnConnect)
+	return options
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket rate limiter with a separate bucket per key,
+// allowing bursts of up to limit messages and refilling limit tokens per
+// interval. The buckets of the least recently used keys are forgotten past
+// maxTopicStates, which only lets their next burst through early.
+type rateLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	interval time.Duration
+	buckets  *topicStates[*tokenBucket]
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:    float64(limit),
+		interval: interval,
+		buckets:  newTopicStates[*tokenBucket](maxTopicStates),
+	}
+}
+
+// allow takes a token from the bucket of key, reporting whether there was one.
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := l.buckets.get(key)
+	if !ok {
+		bucket = &tokenBucket{tokens: l.limit, last: now}
+		l.buckets.set(key, bucket)
+	}
+
+	elapsed := now.Sub(bucket.last)
+	bucket.tokens = min(l.limit, bucket.tokens+l.limit*elapsed.Seconds()/l.interval.Seconds())
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
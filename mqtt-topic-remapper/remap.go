@@ -0,0 +1,1204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/expr-lang/expr/vm"
+	"github.com/ohler55/ojg/jp"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+type Remap struct {
+	From string `toml:"from"`
+	// Name tags the log entries about the remap, which are tagged with from
+	// when it isn't set.
+	Name string `toml:"name"`
+	// FromRegex treats From as a regular expression matched against the whole
+	// incoming topic, for topics MQTT wildcards can't express. Its capture
+	// groups are available in to as {1}, {2}, ... Subscribe is the topic
+	// subscribed to in order to receive them (default "#").
+	FromRegex bool   `toml:"from_regex"`
+	Subscribe string `toml:"subscribe"`
+	// SharedGroup subscribes as $share/<group>/<topic>, so that the broker
+	// delivers each message to only one of the remapper instances in the
+	// group. Shared subscriptions are part of MQTT 5, the broker must also
+	// offer them to MQTT 3.1.1 clients (Mosquitto, EMQX, HiveMQ and others
+	// do). Remaps with the same from should use the same group, each
+	// subscription receives its own copy of the messages.
+	SharedGroup string `toml:"shared_group"`
+	// To is the topic, or the destinations, the remapped messages are
+	// published to. {1}, {2}, ... are replaced with the levels matched by
+	// the + wildcards of from, in order, and {#} with those matched by its
+	// trailing # wildcard, e.g. from = "zigbee2mqtt/+/+" and
+	// to = "home/{2}/{1}". Placeholders referencing a level that from
+	// doesn't capture are refused at load time.
+	To            Destinations      `toml:"to"`
+	ValueMappings map[string]string `toml:"message"`
+	SubQoS        byte              `toml:"sub_qos"`
+	PubQoS        byte              `toml:"pub_qos"`
+	// Replacements is an ordered alternative to ValueMappings: the
+	// replacements are applied one after the other in the order they are
+	// listed, each one to the result of the previous.
+	Replacements []Replacement `toml:"replace"`
+	// Use names a set of value mappings defined in the [mappings] section,
+	// merged with ValueMappings which override it.
+	Use string `toml:"use"`
+	// Retained sets the retained flag of the republished message.
+	Retained bool `toml:"retained"`
+	// RetainFromSource overrides Retained with the retained flag of the incoming message.
+	RetainFromSource bool `toml:"retain_from_source"`
+	// Regex treats the keys of ValueMappings as regular expressions and the values
+	// as replacement templates (supporting $1 style capture references).
+	Regex bool `toml:"regex"`
+	// Glob treats the keys of ValueMappings as glob patterns matched against
+	// the whole payload, where * matches any text. Each * in the value is
+	// substituted with the text matched by the * at the same position in the
+	// key, so "brightness_*" = "*" turns "brightness_50" into "50".
+	Glob bool `toml:"glob"`
+	// Field extracts the value at this dotted JSON path from the payload before
+	// the value mappings are applied.
+	Field string `toml:"field"`
+	// Bidirectional also registers the reverse remap (to -> from) with the value
+	// mappings inverted. No other payload transform can be used with it, since
+	// the reverse remap can't undo them. Without a destination broker, the messages one of
+	// the two remaps publishes are received back by the other, which ignores
+	// them instead of remapping them back in an endless loop.
+	Bidirectional bool `toml:"bidirectional"`
+	// Scale and Offset enable the numeric transform: the payload is parsed as a
+	// number and republished as value*Scale + Offset, rounded to Decimals
+	// decimal places. The value mappings are skipped when it is enabled.
+	Scale    *float64 `toml:"scale"`
+	Offset   *float64 `toml:"offset"`
+	Decimals *int     `toml:"decimals"`
+	// Expression replaces the numeric payload with the result of an arithmetic
+	// expression over it as x, e.g. "(x - 32) * 5 / 9", rounded to Decimals.
+	// It can't be combined with Scale and Offset.
+	Expression string `toml:"expression"`
+	// Convert applies one of the named unit conversions (see conversions) to
+	// the numeric payload, e.g. "f_to_c", rounded to Decimals.
+	Convert string `toml:"convert"`
+	// Round rounds the result of the numeric transform to at most this many
+	// decimal places, trimming the trailing zeros that Decimals keeps (21.50
+	// becomes 21.5). Format formats it with a printf verb instead, e.g.
+	// "%.1f", or "%06.2f" for fixed-width output. Either can be used alone
+	// to reformat a numeric payload. Without Decimals, Round or Format the
+	// result keeps its full precision.
+	Round  *int   `toml:"round"`
+	Format string `toml:"format"`
+	// Rename moves the fields of JSON object payloads, keyed by their dotted
+	// path, to the dotted path they map to, e.g. "t" = "temperature" or
+	// "sensor.h" = "humidity". It applies after field, jsonpath and the
+	// value transforms, and payloads that aren't JSON objects are left
+	// unchanged.
+	Rename map[string]string `toml:"rename"`
+	// Threshold turns the numeric payload into one of two states depending
+	// on which side of a cutoff it is, after the numeric transform if any,
+	// optionally with hysteresis.
+	Threshold *Threshold `toml:"threshold"`
+	// TimeFormat reformats the timestamp payload, or a timestamp field of
+	// it, from one layout to another before the value transforms, see
+	// TimeFormat. Payloads that aren't valid timestamps are dropped.
+	TimeFormat *TimeFormat `toml:"time_format"`
+	// Invert swaps the payloads that are one of the values of a true/false
+	// pair for the other value, e.g. for active-low relays. The pairs are
+	// ON/OFF, true/false and 1/0 unless InvertValues sets the only pair, as
+	// ["true value", "false value"]. Other payloads are left unchanged.
+	Invert       bool     `toml:"invert"`
+	InvertValues []string `toml:"invert_values"`
+	// Default replaces payloads that don't match any value mapping key (or any
+	// pattern in regex mode) instead of letting them pass through unchanged.
+	Default *string `toml:"default"`
+	// DropUnmatched silently drops payloads that don't match any value mapping key.
+	DropUnmatched bool `toml:"drop_unmatched"`
+	// Match selects how the value mapping keys are matched against the payload:
+	// "substring" (default) replaces every occurrence of a key, while "exact"
+	// only rewrites the payload if it is equal to a key in its entirety.
+	Match string `toml:"match"`
+	// CaseInsensitive matches the value mapping keys regardless of case. Keys
+	// that only differ by case are rejected at load time since it would be
+	// ambiguous which one to use. It doesn't apply to destination mappings.
+	CaseInsensitive bool `toml:"case_insensitive"`
+	// StripPrefix and AddPrefix derive the destination topic from the incoming
+	// topic when To is empty: StripPrefix is removed from the topic (if it starts
+	// with it) and AddPrefix is prepended to the result.
+	StripPrefix string `toml:"strip_prefix"`
+	AddPrefix   string `toml:"add_prefix"`
+	// Schema is the path of a JSON Schema file incoming payloads are validated
+	// against. Payloads that don't validate are dropped.
+	Schema string `toml:"schema"`
+	// DeadLetterTopic receives the messages of this remap that fail to be
+	// remapped, overriding the global dead_letter_topic.
+	DeadLetterTopic string `toml:"dead_letter_topic"`
+	// AllowValues and DenyValues filter the remapped payload: when AllowValues
+	// is set only the listed payloads are forwarded, and payloads listed in
+	// DenyValues are never forwarded. Min and Max do the same for numeric
+	// payloads, dropping non-numeric ones.
+	AllowValues []string `toml:"allow_values"`
+	DenyValues  []string `toml:"deny_values"`
+	Min         *float64 `toml:"min"`
+	Max         *float64 `toml:"max"`
+	// RateLimit is the maximum number of messages published to each
+	// destination topic per RateLimitInterval (default 1s), excess messages
+	// are dropped. Every topic matched by a wildcard has its own limit, for
+	// up to maxTopicStates topics.
+	RateLimit         int           `toml:"rate_limit"`
+	RateLimitInterval time.Duration `toml:"rate_limit_interval"`
+	// Dedupe suppresses payloads identical to the last one published to the
+	// same destination topic. If DedupeMaxAge is set, an unchanged payload is
+	// still republished once that long has passed since it was last sent.
+	Dedupe       bool          `toml:"dedupe"`
+	DedupeMaxAge time.Duration `toml:"dedupe_max_age"`
+	// MinDelta suppresses numeric payloads differing by less than this from
+	// the last value published to the same destination topic, e.g. the
+	// jitter of a sensor. If MinDeltaMaxAge is set, a value within the
+	// deadband is still published once that long has passed since the last
+	// one was sent. Payloads that aren't numbers are always published.
+	MinDelta       *float64      `toml:"min_delta"`
+	MinDeltaMaxAge time.Duration `toml:"min_delta_max_age"`
+	// StaleAfter publishes StalePayload (default "unavailable") to StaleTopic,
+	// which supports the same {1} placeholders as to, when no message was
+	// received on a source topic for this long, e.g. because the sensor
+	// died. FreshPayload, if set, is published to it once a message is
+	// received again. Every topic matched by a wildcard has its own timer,
+	// started by its first message. They are published with pub_qos and
+	// retained.
+	StaleAfter   time.Duration `toml:"stale_after"`
+	StaleTopic   string        `toml:"stale_topic"`
+	StalePayload *string       `toml:"stale_payload"`
+	FreshPayload *string       `toml:"fresh_payload"`
+	// Debounce delays publishing to each destination topic until no new
+	// message arrived for this long, then publishes only the latest value.
+	Debounce time.Duration `toml:"debounce"`
+	// Batch adds the remapped payloads to the named batch, under the key
+	// BatchKey (default the incoming topic) which supports the same {1}
+	// placeholders as to. To can be omitted when it is set.
+	Batch    string `toml:"batch"`
+	BatchKey string `toml:"batch_key"`
+	// Template is a text/template rendered with the remapped payload to build
+	// the published payload, see templateData for the available fields.
+	Template string `toml:"template"`
+	// Passthrough also republishes the remapped payload to the topic the
+	// message was received on, for existing consumers of it. The copies the
+	// broker sends back to the remapper are ignored, but another remap routing
+	// To back to From would still loop, so such configs are refused.
+	Passthrough bool `toml:"passthrough"`
+	// Condition only lets the payloads meeting it through the remap, see
+	// condition for the syntax. Payloads that don't meet it are published
+	// unchanged to ElseTo if set (which supports the same {1} placeholders as
+	// to), and dropped otherwise.
+	Condition string `toml:"condition"`
+	ElseTo    string `toml:"else_to"`
+	// Exec pipes the remapped payload to the stdin of this command (and its
+	// arguments) and publishes its stdout instead. It is killed after
+	// ExecTimeout (default 5s) and at most ExecConcurrency (default 4) commands
+	// run at once per remap. Messages are dropped if the command fails.
+	Exec            []string      `toml:"exec"`
+	ExecTimeout     time.Duration `toml:"exec_timeout"`
+	ExecConcurrency int           `toml:"exec_concurrency"`
+	// JSONMinify compacts JSON payloads to a single line and JSONPretty indents
+	// them, after the value mappings are applied. Payloads that aren't valid
+	// JSON are left unchanged.
+	JSONMinify bool `toml:"json_minify"`
+	JSONPretty bool `toml:"json_pretty"`
+	// TimestampField sets this field of JSON object payloads to the time the
+	// message was remapped, other payloads are published unchanged.
+	// TimestampTopic publishes the time to the destination topic with this
+	// suffix appended (e.g. "/timestamp") instead. TimestampFormat is one of
+	// "rfc3339" (default), "unix" or "unix_ms".
+	TimestampField  string `toml:"timestamp_field"`
+	TimestampTopic  string `toml:"timestamp_topic"`
+	TimestampFormat string `toml:"timestamp_format"`
+	// JSONPath extracts the value matched by this JSONPath expression (e.g.
+	// "$.sensors[0].temp") from the payload, like Field but with array
+	// indexing and filters. With JSONPathRewrite the matched value is
+	// transformed and written back, publishing the rest of the document
+	// unchanged. JSONPathMultiple decides what to do when the expression
+	// matches several values: "first" (default) uses the first one and "drop"
+	// drops the message.
+	JSONPath         string `toml:"jsonpath"`
+	JSONPathRewrite  bool   `toml:"jsonpath_rewrite"`
+	JSONPathMultiple string `toml:"jsonpath_multiple"`
+	// MessageExpiry drops the remapped messages not published within this
+	// duration of being received, e.g. commands held in the offline buffer
+	// while disconnected. MQTT 5 would let the broker expire them too, but
+	// the client library only speaks MQTT 3.1.1, so once published they are
+	// delivered however late the subscribers are.
+	MessageExpiry time.Duration `toml:"message_expiry"`
+	// Binary republishes the payload bytes verbatim, only changing the topic,
+	// for payloads that aren't text (e.g. protobuf or images). None of the
+	// options transforming the payload as text can be used with it.
+	Binary bool `toml:"binary"`
+	// Enabled (default true) can be set to false to pause the remap without
+	// removing it: it is still validated but isn't subscribed to.
+	Enabled *bool `toml:"enabled"`
+	// MaxPayloadSize drops the incoming messages larger than this number of
+	// bytes before they are remapped, overriding the global max_payload_size
+	// (0 for no limit).
+	MaxPayloadSize int `toml:"max_payload_size"`
+	// Pipeline is a list of steps run in order after the remap's own
+	// transforms, each one transforming the output of the previous. A step
+	// takes the same payload options as a remap (message, regex, field,
+	// scale, expression, template, ...) but none of the routing ones, and the
+	// message is dropped if any step drops it.
+	Pipeline []Remap `toml:"pipeline"`
+	// Delay defers publishing the remapped messages by this duration, keeping
+	// their order per destination topic. At most maxDelayed messages are
+	// delayed at once, the next ones are dropped. What happens to the
+	// messages still delayed on shutdown is set by the global delay_shutdown.
+	Delay time.Duration `toml:"delay"`
+	// Split publishes each field of a JSON payload on its own topic instead
+	// of publishing the payload to to. The keys are dotted field paths and
+	// the values destination topics, which can reference the captures of
+	// from as {1}, {2}, ... Fields missing from the payload are skipped.
+	Split map[string]string `toml:"split"`
+	// Routes publishes the payload to the first of these routes it matches
+	// instead of to, like a switch statement. Payloads matching no route are
+	// dropped unless the last one is a default route, see Route.
+	Routes []Route `toml:"routes"`
+	// Merge is the name of a merge combining the latest payload of this
+	// remap, under MergeField (which supports the {1} placeholders of from),
+	// with those of the other remaps referencing it into one JSON object.
+	Merge      string `toml:"merge"`
+	MergeField string `toml:"merge_field"`
+	// Decompress ("gzip") inflates the incoming payload before anything else
+	// is done with it, dropping the messages that aren't validly compressed.
+	// Compress ("gzip") compresses the payloads published to to or split,
+	// but not those of batches and merges.
+	Decompress string `toml:"decompress"`
+	Compress   string `toml:"compress"`
+	// Base64Encode encodes the incoming payload as base64 before it is
+	// transformed (after decompress), and Base64Decode decodes the remapped
+	// payload last, e.g. a base64 field extracted with field, publishing the
+	// decoded bytes as they are. Payloads that aren't valid base64 are
+	// dropped.
+	Base64Encode bool `toml:"base64_encode"`
+	Base64Decode bool `toml:"base64_decode"`
+	// Discovery announces to as a Home Assistant entity, see Discovery.
+	Discovery *Discovery `toml:"discovery"`
+	// RepublishOnConnect keeps the last message published to each topic of
+	// to, split or routes and republishes it whenever the remapper
+	// (re)connects, so consumers recover the values the remap depends on
+	// after a broker restart. See the global republish_cache_size and
+	// republish_cache_file.
+	RepublishOnConnect bool `toml:"republish_on_connect"`
+
+	patterns      []valuePattern
+	globs         []valuePattern
+	replacer      *strings.Replacer
+	folded        *regexp.Regexp
+	lowerMappings map[string]string
+	inverted      map[string]string
+	schema        *jsonschema.Schema
+	topicRegex    *regexp.Regexp
+	expression    *vm.Program
+	conversion    conversion
+	condition     *condition
+	jsonPath      jp.Expr
+	// textTransforms is set when any option treats the payload as text.
+	textTransforms bool
+	// pipelineStep is set on the steps of a pipeline, which have no topics.
+	pipelineStep bool
+	// file is the config file the remap was loaded from.
+	file string
+	// log is the logger tagged with the name of the remap.
+	log *slog.Logger
+
+	deadLetterTopic string
+	maxPayloadSize  int
+	limiter         *rateLimiter
+	deduplicator    *deduplicator
+	deltaFilter     *deltaFilter
+	staleWatcher    *staleWatcher
+	template        *template.Template
+	// echoes recognises the copies the broker sends back of the messages
+	// published by the remap: its passthrough copies, or with reverseEchoes
+	// every message published by either remap of a bidirectional remap,
+	// which share it.
+	echoes        *echoFilter
+	reverseEchoes bool
+	debouncer     *debouncer
+	delayer       *delayer
+	batcher       *batcher
+	merger        *merger
+	command       *commandRunner
+}
+
+const (
+	matchSubstring = "substring"
+	matchExact     = "exact"
+)
+
+// Replacement is a value mapping of an ordered replace list.
+type Replacement struct {
+	From string `toml:"from"`
+	To   string `toml:"to"`
+}
+
+type valuePattern struct {
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// validate returns every problem found in the remap.
+func (r Remap) validate() error {
+	var errs []error
+	if r.From == "" {
+		errs = append(errs, fmt.Errorf("remap to %s: missing from", r.To))
+	}
+	for _, destination := range r.To {
+		if destination.Topic == r.From {
+			errs = append(errs, fmt.Errorf("remap from %s: to is the same topic as from, which would create a loop", r.From))
+		}
+	}
+	if r.SubQoS > 2 {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid sub_qos %d (must be 0, 1 or 2)", r.From, r.SubQoS))
+	}
+	if r.PubQoS > 2 {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid pub_qos %d (must be 0, 1 or 2)", r.From, r.PubQoS))
+	}
+	if r.Decimals != nil && *r.Decimals < 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid decimals %d (must not be negative)", r.From, *r.Decimals))
+	}
+	errs = append(errs, r.validateNumberFormat()...)
+	if len(r.To) == 0 && r.StripPrefix == "" && r.AddPrefix == "" && r.Batch == "" && len(r.Split) == 0 && len(r.Routes) == 0 && r.Merge == "" && !r.pipelineStep {
+		errs = append(errs, fmt.Errorf("remap from %s: missing to (or strip_prefix/add_prefix, batch, split, routes or merge)", r.From))
+	}
+	errs = append(errs, r.validateRoutes()...)
+	errs = append(errs, r.validateCaptures()...)
+	if r.SharedGroup != "" && strings.ContainsAny(r.SharedGroup, "/+#") {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid shared_group %q (must not contain /, + or #)", r.From, r.SharedGroup))
+	}
+	if (r.Merge == "") != (r.MergeField == "") {
+		errs = append(errs, fmt.Errorf("remap from %s: merge and merge_field must be set together", r.From))
+	}
+	if len(r.Split) > 0 && (len(r.To) > 0 || r.StripPrefix != "" || r.AddPrefix != "") {
+		errs = append(errs, fmt.Errorf("remap from %s: split can't be used together with to, strip_prefix and add_prefix", r.From))
+	}
+	for field, topic := range r.Split {
+		if field == "" || topic == "" {
+			errs = append(errs, fmt.Errorf("remap from %s: invalid split %q = %q (field and topic must not be empty)", r.From, field, topic))
+		}
+	}
+	if len(r.To) > 0 && (r.StripPrefix != "" || r.AddPrefix != "") {
+		errs = append(errs, fmt.Errorf("remap from %s: strip_prefix and add_prefix can't be used together with to", r.From))
+	}
+	if r.Glob && (r.Regex || len(r.Replacements) > 0 || r.Match != "") {
+		errs = append(errs, fmt.Errorf("remap from %s: glob can't be used together with regex, replace and match", r.From))
+	}
+	if r.Match != "" && r.Match != matchSubstring && r.Match != matchExact {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid match %s (must be %s or %s)", r.From, r.Match, matchSubstring, matchExact))
+	}
+	if r.RateLimit < 0 || r.RateLimitInterval < 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid rate limit %d per %s", r.From, r.RateLimit, r.RateLimitInterval))
+	}
+	errs = append(errs, r.validateStale()...)
+	if r.MinDelta != nil && *r.MinDelta <= 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid min_delta %g (must be positive)", r.From, *r.MinDelta))
+	}
+	if r.MinDeltaMaxAge < 0 || (r.MinDeltaMaxAge != 0 && r.MinDelta == nil) {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid min_delta_max_age %s (must be positive and used with min_delta)", r.From, r.MinDeltaMaxAge))
+	}
+	if r.DedupeMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid dedupe_max_age %s (must not be negative)", r.From, r.DedupeMaxAge))
+	}
+	if options := r.textOptions(); r.Binary && len(options) > 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: binary can't be used together with %s", r.From, strings.Join(options, ", ")))
+	}
+	if r.MaxPayloadSize < 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid max_payload_size %d (must not be negative)", r.From, r.MaxPayloadSize))
+	}
+	if r.MessageExpiry < 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid message_expiry %s (must be positive)", r.From, r.MessageExpiry))
+	}
+	if r.ExecTimeout < 0 || r.ExecConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid exec_timeout %s or exec_concurrency %d (must not be negative)", r.From, r.ExecTimeout, r.ExecConcurrency))
+	}
+	if r.Debounce < 0 || r.Delay < 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid debounce %s or delay %s (must not be negative)", r.From, r.Debounce, r.Delay))
+	}
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		errs = append(errs, fmt.Errorf("remap from %s: min %g is greater than max %g", r.From, *r.Min, *r.Max))
+	}
+	if r.TimestampFormat != "" && r.TimestampFormat != timestampRFC3339 && r.TimestampFormat != timestampUnix && r.TimestampFormat != timestampUnixMs {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid timestamp_format %s (must be %s, %s or %s)", r.From, r.TimestampFormat, timestampRFC3339, timestampUnix, timestampUnixMs))
+	}
+	if r.JSONMinify && r.JSONPretty {
+		errs = append(errs, fmt.Errorf("remap from %s: json_minify and json_pretty can't be used together", r.From))
+	}
+	if r.Expression != "" && (r.Scale != nil || r.Offset != nil) {
+		errs = append(errs, fmt.Errorf("remap from %s: expression can't be used together with scale and offset", r.From))
+	}
+	if r.Convert != "" && (r.Expression != "" || r.Scale != nil || r.Offset != nil) {
+		errs = append(errs, fmt.Errorf("remap from %s: convert can't be used together with expression, scale and offset", r.From))
+	}
+	if r.Passthrough && r.Bidirectional {
+		errs = append(errs, fmt.Errorf("remap from %s: passthrough can't be used together with bidirectional", r.From))
+	}
+	if options := r.irreversibleOptions(); r.Bidirectional && len(options) > 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: bidirectional remaps can only invert message, %s can't be reversed", r.From, strings.Join(options, ", ")))
+	}
+	if len(r.Replacements) > 0 && len(r.ValueMappings) > 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: message and replace can't be used together", r.From))
+	}
+	if r.Subscribe != "" && !r.FromRegex {
+		errs = append(errs, fmt.Errorf("remap from %s: subscribe can only be used with from_regex", r.From))
+	}
+	if r.ElseTo != "" && r.Condition == "" {
+		errs = append(errs, fmt.Errorf("remap from %s: else_to is set without a condition", r.From))
+	}
+	if r.ElseTo != "" && r.ElseTo == r.From {
+		errs = append(errs, fmt.Errorf("remap from %s: else_to is the same topic as from, which would create a loop", r.From))
+	}
+	if r.JSONPath != "" && r.Field != "" {
+		errs = append(errs, fmt.Errorf("remap from %s: jsonpath and field can't be used together", r.From))
+	}
+	if r.JSONPath == "" && (r.JSONPathRewrite || r.JSONPathMultiple != "") {
+		errs = append(errs, fmt.Errorf("remap from %s: jsonpath_rewrite and jsonpath_multiple require jsonpath", r.From))
+	}
+	if r.JSONPathMultiple != "" && r.JSONPathMultiple != jsonPathFirst && r.JSONPathMultiple != jsonPathDrop {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid jsonpath_multiple %q (must be %q or %q)", r.From, r.JSONPathMultiple, jsonPathFirst, jsonPathDrop))
+	}
+	if r.Decompress != "" && r.Decompress != compressionGzip {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid decompress %q (must be %q)", r.From, r.Decompress, compressionGzip))
+	}
+	if r.Compress != "" && r.Compress != compressionGzip {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid compress %q (must be %q)", r.From, r.Compress, compressionGzip))
+	}
+	if r.Base64Encode && r.Base64Decode {
+		errs = append(errs, fmt.Errorf("remap from %s: base64_encode and base64_decode can't be used together", r.From))
+	}
+	if r.Base64Decode && (len(r.Split) > 0 || r.Batch != "" || r.Merge != "") {
+		errs = append(errs, fmt.Errorf("remap from %s: base64_decode can't be used together with split, batch and merge, which need text payloads", r.From))
+	}
+	if r.Default != nil && r.DropUnmatched {
+		errs = append(errs, fmt.Errorf("remap from %s: default and drop_unmatched can't be used together", r.From))
+	}
+	if r.Discovery != nil {
+		errs = append(errs, r.validateDiscovery()...)
+	}
+	if r.TimeFormat != nil {
+		errs = append(errs, r.TimeFormat.validate(r.From)...)
+	}
+	errs = append(errs, r.validateInvert()...)
+	errs = append(errs, r.validateRename()...)
+	if r.Threshold != nil {
+		errs = append(errs, r.Threshold.validate(r.From)...)
+		if len(r.ValueMappings) > 0 || len(r.Replacements) > 0 || r.Default != nil || r.DropUnmatched {
+			errs = append(errs, fmt.Errorf("remap from %s: threshold can't be used together with message, replace, default and drop_unmatched", r.From))
+		}
+	}
+	for i := range r.Pipeline {
+		if err := r.Pipeline[i].validateStep(r.From, i); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// irreversibleOptions returns the options of r transforming or routing the
+// payload other than its value mappings, which the reverse remap would apply
+// a second time rather than undo.
+func (r Remap) irreversibleOptions() []string {
+	var options []string
+	for _, option := range r.textOptions() {
+		if option != "message" {
+			options = append(options, option)
+		}
+	}
+	add := func(name string, set bool) {
+		if set {
+			options = append(options, name)
+		}
+	}
+	add("decompress", r.Decompress != "")
+	add("compress", r.Compress != "")
+	add("base64_encode or base64_decode", r.Base64Encode || r.Base64Decode)
+	add("timestamp_topic", r.TimestampTopic != "")
+	return options
+}
+
+// reverse returns the remap going from r.To back to r.From, with inverted value
+// mappings and swapped QoS levels.
+func (r Remap) reverse() (Remap, error) {
+	if isWildcardTopic(r.From) || r.FromRegex || r.Regex || r.Glob || len(r.Pipeline) > 0 || r.Threshold != nil || r.TimeFormat != nil || r.Field != "" || r.JSONPath != "" || len(r.Replacements) > 0 || len(r.To) != 1 || isTopicTemplate(r.To[0].Topic) {
+		return Remap{}, fmt.Errorf("remap from %s: bidirectional remaps can't use wildcards, from_regex, regex, glob, pipeline, threshold, time_format, field, jsonpath, replace, multiple destinations or to templates", r.From)
+	}
+
+	inverted := make(map[string]string, len(r.ValueMappings))
+	for from, to := range r.ValueMappings {
+		if other, ok := inverted[to]; ok {
+			return Remap{}, fmt.Errorf("remap from %s: can't invert value mappings, both %s and %s map to %s", r.From, other, from, to)
+		}
+		inverted[to] = from
+	}
+
+	reverse := r
+	reverse.From = r.To[0].Topic
+	reverse.To = Destinations{{Topic: r.From}}
+	reverse.ValueMappings = inverted
+	reverse.SubQoS = r.PubQoS
+	reverse.PubQoS = r.SubQoS
+	reverse.Bidirectional = false
+	reverse.Discovery = nil
+	reverse.StaleAfter, reverse.StaleTopic, reverse.StalePayload, reverse.FreshPayload = 0, "", nil, nil
+	if r.Name != "" {
+		reverse.Name = r.Name + " reverse"
+	}
+	return reverse, nil
+}
+
+// compile precompiles everything needed by remap so it doesn't have to be done per message.
+func (r *Remap) compile() error {
+	r.log = slog.With("remap", r.tag())
+	r.textTransforms = len(r.textOptions()) > 0
+	for i := range r.Pipeline {
+		if r.Name != "" && r.Pipeline[i].Name == "" {
+			r.Pipeline[i].Name = fmt.Sprintf("%s pipeline step %d", r.Name, i+1)
+		}
+		if err := r.Pipeline[i].compile(); err != nil {
+			return err
+		}
+	}
+	if r.Threshold != nil {
+		r.Threshold.compile(r.tag())
+	}
+	if r.TimeFormat != nil {
+		if err := r.TimeFormat.compile(r.From); err != nil {
+			return err
+		}
+	}
+	if r.RateLimit > 0 {
+		interval := r.RateLimitInterval
+		if interval == 0 {
+			interval = time.Second
+		}
+		r.limiter = newRateLimiter(r.RateLimit, interval)
+	}
+	if r.Dedupe {
+		r.deduplicator = newDeduplicator(r.DedupeMaxAge)
+	}
+	if r.MinDelta != nil {
+		r.deltaFilter = newDeltaFilter(*r.MinDelta, r.MinDeltaMaxAge)
+	}
+	if r.StaleAfter > 0 {
+		r.staleWatcher = newStaleWatcher(*r)
+	}
+	if r.Passthrough {
+		r.echoes = newEchoFilter()
+	}
+	if r.Debounce > 0 {
+		r.debouncer = newDebouncer(r.Debounce)
+	}
+	if r.Delay > 0 {
+		r.delayer = newDelayer(r.Delay)
+	}
+	if len(r.Exec) > 0 {
+		timeout, concurrency := r.ExecTimeout, r.ExecConcurrency
+		if timeout == 0 {
+			timeout = 5 * time.Second
+		}
+		if concurrency == 0 {
+			concurrency = 4
+		}
+		r.command = newCommandRunner(r.Exec, timeout, concurrency)
+	}
+	if r.Template != "" {
+		tmpl, err := template.New(r.From).Option("missingkey=error").Parse(r.Template)
+		if err != nil {
+			return fmt.Errorf("remap from %s: invalid template: %s", r.From, err)
+		}
+		r.template = tmpl
+	}
+
+	if r.FromRegex {
+		regex, err := regexp.Compile("^(?:" + r.From + ")$")
+		if err != nil {
+			return fmt.Errorf("remap from %s: invalid from_regex: %s", r.From, err)
+		}
+		r.topicRegex = regex
+	}
+
+	if r.Expression != "" {
+		program, err := compileExpression(r.Expression)
+		if err != nil {
+			return fmt.Errorf("remap from %s: invalid expression %q: %s", r.From, r.Expression, err)
+		}
+		r.expression = program
+	}
+
+	if r.JSONPath != "" {
+		expr, err := jp.ParseString(r.JSONPath)
+		if err != nil {
+			return fmt.Errorf("remap from %s: invalid jsonpath %q: %s", r.From, r.JSONPath, err)
+		}
+		r.jsonPath = expr
+	}
+
+	if r.Convert != "" {
+		conversion, ok := conversions[r.Convert]
+		if !ok {
+			return fmt.Errorf("remap from %s: unknown conversion %s", r.From, r.Convert)
+		}
+		r.conversion = conversion
+	}
+
+	if r.Condition != "" {
+		condition, err := parseCondition(r.Condition)
+		if err != nil {
+			return fmt.Errorf("remap from %s: invalid condition %q: %s", r.From, r.Condition, err)
+		}
+		r.condition = condition
+	}
+
+	if r.Schema != "" {
+		schema, err := jsonschema.Compile(r.Schema)
+		if err != nil {
+			return fmt.Errorf("remap from %s: invalid schema %s: %s", r.From, r.Schema, err)
+		}
+		r.schema = schema
+	}
+
+	if r.CaseInsensitive {
+		r.lowerMappings = make(map[string]string, len(r.ValueMappings))
+		keys := make(map[string]string, len(r.ValueMappings))
+		for from, to := range r.ValueMappings {
+			lower := strings.ToLower(from)
+			if other, ok := keys[lower]; ok {
+				return fmt.Errorf("remap from %s: keys %s and %s only differ by case", r.From, other, from)
+			}
+			keys[lower] = from
+			r.lowerMappings[lower] = to
+		}
+	}
+
+	if r.Invert {
+		r.inverted = r.inversions()
+	}
+
+	if err := r.compileRoutes(); err != nil {
+		return err
+	}
+
+	if r.Glob {
+		for _, from := range sortedKeys(r.ValueMappings) {
+			glob, err := compileGlob(from, r.ValueMappings[from], r.CaseInsensitive)
+			if err != nil {
+				return fmt.Errorf("remap from %s: invalid glob %s: %s", r.From, from, err)
+			}
+			r.globs = append(r.globs, glob)
+		}
+	} else if !r.usesPatterns() && r.Match != matchExact {
+		if r.CaseInsensitive && len(r.ValueMappings) > 0 {
+			r.folded = newFoldedReplacer(r.ValueMappings)
+		} else {
+			r.replacer = newValueReplacer(r.ValueMappings)
+		}
+		if from, other, ok := overlappingKeys(r.ValueMappings); ok {
+			r.logger().Warn("Value mapping keys overlap, the longest one is used where both match, use replace to define the order", "from", r.From, "key", from, "overlapping_key", other)
+		}
+	}
+	for i := range r.To {
+		if r.Match != matchExact {
+			r.To[i].replacer = newValueReplacer(r.To[i].ValueMappings)
+		}
+		if err := r.To[i].compile(r.From); err != nil {
+			return err
+		}
+	}
+
+	if r.usesPatterns() {
+		// Patterns are applied one after the other, so the value mappings are
+		// sorted the same way as the substring replacements to get a stable
+		// result.
+		replacements := r.Replacements
+		if len(replacements) == 0 {
+			for _, from := range sortedKeys(r.ValueMappings) {
+				replacements = append(replacements, Replacement{From: from, To: r.ValueMappings[from]})
+			}
+		}
+		for _, mapping := range replacements {
+			from, expr, replacement := mapping.From, mapping.From, mapping.To
+			if !r.Regex {
+				expr = regexp.QuoteMeta(from)
+				replacement = strings.ReplaceAll(replacement, "$", "$$")
+			}
+			if r.Match == matchExact {
+				expr = "^(?:" + expr + ")$"
+			}
+			if r.CaseInsensitive {
+				expr = "(?i)" + expr
+			}
+			regex, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("remap from %s: invalid regex %s: %s", r.From, from, err)
+			}
+			r.patterns = append(r.patterns, valuePattern{regex: regex, replacement: replacement})
+		}
+	}
+	return nil
+}
+
+// usesPatterns reports whether the value mappings are applied through the
+// compiled patterns, one after the other, which is the case in regex mode and
+// for ordered replacements.
+func (r Remap) usesPatterns() bool {
+	return r.Regex || len(r.Replacements) > 0
+}
+
+// subscription returns the topic subscribed to in order to receive the
+// messages of the remap, as a shared subscription with shared_group.
+func (r Remap) subscription() string {
+	topic := "#"
+	if !r.FromRegex {
+		topic = r.From
+	} else if r.Subscribe != "" {
+		topic = r.Subscribe
+	}
+	if r.SharedGroup != "" {
+		return "$share/" + r.SharedGroup + "/" + topic
+	}
+	return topic
+}
+
+// subscriptionFilter returns the topic filter of subscription, without the
+// $share/<group>/ prefix of shared subscriptions, which the topics of the
+// messages received through them don't have.
+func subscriptionFilter(subscription string) string {
+	if shared, ok := strings.CutPrefix(subscription, "$share/"); ok {
+		if _, filter, ok := strings.Cut(shared, "/"); ok {
+			return filter
+		}
+	}
+	return subscription
+}
+
+// matchTopic reports whether the remap handles topic and returns the levels
+// captured by the wildcards, or the regex capture groups with from_regex.
+func (r Remap) matchTopic(topic string) ([]string, bool) {
+	if r.topicRegex == nil {
+		return matchTopic(r.From, topic)
+	}
+	match := r.topicRegex.FindStringSubmatch(topic)
+	if match == nil {
+		return nil, false
+	}
+	return match[1:], true
+}
+
+// destinations returns the destinations of a message received on topic, with
+// the templates rendered with the received payload, the wildcard captures
+// expanded or the prefixes applied. An error means a template couldn't be
+// rendered and the message should be dropped.
+func (r Remap) destinations(topic string, captures []string, received string) (Destinations, error) {
+	if len(r.To) == 0 {
+		if r.StripPrefix == "" && r.AddPrefix == "" {
+			return nil, nil
+		}
+		return Destinations{{Topic: r.AddPrefix + r.stripPrefix(topic)}}, nil
+	}
+	destinations := make(Destinations, len(r.To))
+	var document any
+	for i, destination := range r.To {
+		if destination.topicTemplate != nil {
+			rendered, err := destination.renderTopic(received, &document)
+			if err != nil {
+				return nil, err
+			}
+			destination.Topic = rendered
+		}
+		destination.Topic = expandTopic(destination.Topic, captures)
+		if destination.topicTemplate != nil && !validRenderedTopic(destination.Topic) {
+			return nil, fmt.Errorf("to %s rendered invalid topic %q", r.To[i].Topic, destination.Topic)
+		}
+		destinations[i] = destination
+	}
+	return destinations, nil
+}
+
+// batchKey returns the key the payload of a message received on topic is
+// stored under in the batch.
+func (r Remap) batchKey(topic string, captures []string) string {
+	if r.BatchKey == "" {
+		return topic
+	}
+	return expandTopic(r.BatchKey, captures)
+}
+
+// tag returns the name of r, or its from if it has none.
+func (r Remap) tag() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.From
+}
+
+// logger returns the logger of the log entries about r, tagged with its name.
+func (r Remap) logger() *slog.Logger {
+	if r.log == nil {
+		return slog.With("remap", r.tag())
+	}
+	return r.log
+}
+
+func (r Remap) stripPrefix(topic string) string {
+	if r.StripPrefix == "" {
+		return topic
+	}
+	stripped, ok := strings.CutPrefix(topic, r.StripPrefix)
+	if !ok {
+		r.logger().Warn("Topic doesn't start with strip_prefix, leaving it unchanged", "topic", topic, "strip_prefix", r.StripPrefix)
+		return topic
+	}
+	return stripped
+}
+
+func (r Remap) retained(msg mqtt.Message) bool {
+	if r.RetainFromSource {
+		return msg.Retained()
+	}
+	return r.Retained
+}
+
+func (r Remap) enabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// textOptions returns the names of the options set on r that transform the
+// payload as text, which would corrupt binary payloads.
+func (r Remap) textOptions() []string {
+	var options []string
+	add := func(name string, set bool) {
+		if set {
+			options = append(options, name)
+		}
+	}
+	add("message", len(r.ValueMappings) > 0)
+	add("replace", len(r.Replacements) > 0)
+	add("field", r.Field != "")
+	add("jsonpath", r.JSONPath != "")
+	add("scale, offset, decimals, round or format", r.Scale != nil || r.Offset != nil || r.Decimals != nil || r.Round != nil || r.Format != "")
+	add("expression", r.Expression != "")
+	add("convert", r.Convert != "")
+	add("rename", len(r.Rename) > 0)
+	add("threshold", r.Threshold != nil)
+	add("time_format", r.TimeFormat != nil)
+	add("invert", r.Invert)
+	add("default or drop_unmatched", r.Default != nil || r.DropUnmatched)
+	add("schema", r.Schema != "")
+	add("allow_values, deny_values, min or max", len(r.AllowValues) > 0 || len(r.DenyValues) > 0 || r.Min != nil || r.Max != nil)
+	add("condition", r.Condition != "")
+	add("template", r.Template != "")
+	add("exec", len(r.Exec) > 0)
+	add("json_minify or json_pretty", r.JSONMinify || r.JSONPretty)
+	add("timestamp_field", r.TimestampField != "")
+	add("batch", r.Batch != "")
+	add("pipeline", len(r.Pipeline) > 0)
+	add("split", len(r.Split) > 0)
+	add("merge", r.Merge != "")
+	for _, destination := range r.To {
+		add("message in to "+destination.Topic, len(destination.ValueMappings) > 0)
+	}
+	return options
+}
+
+// errUnmatched is returned by remap when a message is dropped because of
+// drop_unmatched. It is expected, so it isn't worth a warning.
+var errUnmatched = errors.New("payload doesn't match any value mapping")
+
+// matches reports whether payload is exactly one of the value mapping keys,
+// or in regex and glob mode whether any of the patterns matches it.
+func (r Remap) matches(payload string) bool {
+	if r.Glob {
+		for _, glob := range r.globs {
+			if glob.regex.MatchString(payload) {
+				return true
+			}
+		}
+		return false
+	}
+	if r.Regex {
+		for _, pattern := range r.patterns {
+			if pattern.regex.MatchString(payload) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(r.Replacements) > 0 {
+		for _, replacement := range r.Replacements {
+			if payload == replacement.From || (r.CaseInsensitive && strings.EqualFold(payload, replacement.From)) {
+				return true
+			}
+		}
+		return false
+	}
+	if r.CaseInsensitive {
+		_, ok := r.lowerMappings[strings.ToLower(payload)]
+		return ok
+	}
+	_, ok := r.ValueMappings[payload]
+	return ok
+}
+
+func (r Remap) numeric() bool {
+	return r.Scale != nil || r.Offset != nil || r.Expression != "" || r.Convert != "" || r.Round != nil || r.Format != ""
+}
+
+// remapPayload remaps the payload received on topic: it is decompressed and
+// base64 encoded if set, remapped unless the remap is binary, and base64
+// decoded if set. An error means the message should be dropped.
+func (r Remap) remapPayload(topic string, captures []string, payload string) (string, error) {
+	payload, err := r.decompress(payload)
+	if err != nil {
+		return "", err
+	}
+	payload = r.encodeBase64(payload)
+	// Binary payloads are republished as received.
+	if !r.Binary {
+		if r.textTransforms && !utf8.ValidString(payload) {
+			r.logger().Warn("Transforming payload that isn't valid UTF-8, set binary if it isn't text", "topic", topic, "payload_len", len(payload))
+		}
+		if payload, err = r.remap(topic, captures, payload); err != nil {
+			return "", err
+		}
+	}
+	return r.decodeBase64(payload)
+}
+
+// remap transforms and filters the payload according to the remap
+// configuration. An error means the message should be dropped.
+func (r Remap) remap(topic string, captures []string, payload string) (string, error) {
+	if r.condition != nil && !r.condition.met(payload) {
+		return "", errConditionNotMet
+	}
+	payload, err := r.transform(topic, payload)
+	if err != nil {
+		return "", err
+	}
+	if r.command != nil {
+		if payload, err = r.command.run(payload); err != nil {
+			return "", err
+		}
+	}
+	if r.JSONMinify || r.JSONPretty {
+		payload = r.formatJSON(payload)
+	}
+	if ok, reason := r.allowed(payload); !ok {
+		return "", fmt.Errorf("%w: %s", errFiltered, reason)
+	}
+	if r.template != nil {
+		if payload, err = renderTemplate(r.template, topic, captures, payload); err != nil {
+			return "", err
+		}
+	}
+	for _, step := range r.Pipeline {
+		if payload, err = step.remap(topic, captures, payload); err != nil {
+			return "", err
+		}
+	}
+	return payload, nil
+}
+
+func (r Remap) transform(topic string, payload string) (string, error) {
+	if r.schema != nil {
+		value, err := decodeJSON(payload)
+		if err != nil {
+			return "", err
+		}
+		if err := r.schema.Validate(value); err != nil {
+			return "", fmt.Errorf("payload doesn't match schema %s: %s", r.Schema, err)
+		}
+	}
+
+	if r.Field != "" {
+		field, err := extractJSONField(payload, r.Field)
+		if err != nil {
+			return "", err
+		}
+		payload = field
+	}
+
+	if r.TimeFormat != nil {
+		timestamp, err := r.TimeFormat.apply(payload)
+		if err != nil {
+			return "", err
+		}
+		payload = timestamp
+	}
+
+	var err error
+	if r.jsonPath != nil {
+		payload, err = r.transformJSONPath(topic, payload)
+	} else {
+		payload, err = r.transformValue(topic, payload)
+	}
+	if err != nil || len(r.Rename) == 0 {
+		return payload, err
+	}
+	return r.renameKeys(payload), nil
+}
+
+// transformValue applies the numeric transform and threshold, the inversion
+// or the value mappings to a payload received on topic, or to the value
+// extracted from it.
+func (r Remap) transformValue(topic string, payload string) (string, error) {
+	if r.numeric() {
+		number, err := r.transformNumber(payload)
+		if err != nil || r.Threshold == nil {
+			return number, err
+		}
+		payload = number
+	}
+	if r.Threshold != nil {
+		return r.Threshold.apply(topic, payload)
+	}
+	if r.Invert {
+		return r.invert(payload), nil
+	}
+
+	if (r.Default != nil || r.DropUnmatched) && !r.matches(payload) {
+		if r.DropUnmatched {
+			return "", errUnmatched
+		}
+		return *r.Default, nil
+	}
+
+	if r.Glob {
+		return replaceGlob(payload, r.globs), nil
+	}
+	if r.usesPatterns() {
+		for _, pattern := range r.patterns {
+			payload = pattern.regex.ReplaceAllString(payload, pattern.replacement)
+		}
+		return payload, nil
+	}
+	if r.folded != nil {
+		return r.replaceFolded(payload), nil
+	}
+	if r.CaseInsensitive {
+		if to, ok := r.lowerMappings[strings.ToLower(payload)]; ok {
+			return to, nil
+		}
+		return payload, nil
+	}
+	return replaceValues(payload, r.ValueMappings, r.replacer), nil
+}
+
+// transformNumber applies the expression, conversion or scale and offset to
+// the numeric payload.
+func (r Remap) transformNumber(payload string) (string, error) {
+	var value float64
+	var err error
+	if r.expression != nil {
+		value, err = evaluateExpression(r.expression, payload)
+	} else if r.conversion != nil {
+		value, err = convertNumber(payload, r.conversion)
+	} else {
+		scale, offset := 1.0, 0.0
+		if r.Scale != nil {
+			scale = *r.Scale
+		}
+		if r.Offset != nil {
+			offset = *r.Offset
+		}
+		value, err = scaleNumber(payload, scale, offset)
+	}
+	if err != nil {
+		return "", err
+	}
+	return r.formatNumber(value), nil
+}
+
+// replaceValues applies the value mappings to payload. Without a replacer (in
+// exact mode) the payload is replaced only if it is equal to one of the keys,
+// otherwise every occurrence of each key is replaced by the replacer.
+func replaceValues(payload string, mappings map[string]string, replacer *strings.Replacer) string {
+	if replacer != nil {
+		return replacer.Replace(payload)
+	}
+	if to, ok := mappings[payload]; ok {
+		return to
+	}
+	return payload
+}
+
+// newValueReplacer returns a replacer substituting every key of mappings in a
+// single pass, so replaced values are never matched again (with a -> b and
+// b -> c, "ab" becomes "bc"). Where several keys match at the same position
+// the longest one wins.
+func newValueReplacer(mappings map[string]string) *strings.Replacer {
+	oldnew := make([]string, 0, 2*len(mappings))
+	for _, from := range sortedKeys(mappings) {
+		oldnew = append(oldnew, from, mappings[from])
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// newFoldedReplacer returns a regex matching any key of mappings regardless
+// of case, the longest one first where several match at the same position,
+// so that with replaceFolded the case insensitive substring replacements are
+// made in a single pass like with newValueReplacer.
+func newFoldedReplacer(mappings map[string]string) *regexp.Regexp {
+	keys := sortedKeys(mappings)
+	for i, key := range keys {
+		keys[i] = regexp.QuoteMeta(key)
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(keys, "|"))
+}
+
+// replaceFolded replaces every occurrence of the value mapping keys in
+// payload regardless of case, in a single pass.
+func (r Remap) replaceFolded(payload string) string {
+	return r.folded.ReplaceAllStringFunc(payload, func(match string) string {
+		if to, ok := r.lowerMappings[strings.ToLower(match)]; ok {
+			return to
+		}
+		// The regex folds case a bit differently from strings.ToLower, e.g.
+		// "ſ" matches "s" but isn't lowered to it.
+		for from, to := range r.ValueMappings {
+			if strings.EqualFold(from, match) {
+				return to
+			}
+		}
+		return match
+	})
+}
+
+// overlappingKeys returns two keys of mappings where one contains the other,
+// if any, since it may not be obvious which one is used.
+func overlappingKeys(mappings map[string]string) (string, string, bool) {
+	keys := sortedKeys(mappings)
+	for i, key := range keys {
+		for _, other := range keys[i+1:] {
+			if strings.Contains(key, other) {
+				return key, other, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// sortedKeys returns the keys of mappings longest first, and alphabetically
+// among keys of the same length, since map iteration order is random.
+func sortedKeys(mappings map[string]string) []string {
+	keys := make([]string, 0, len(mappings))
+	for from := range mappings {
+		keys = append(keys, from)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+		return strings.Compare(a, b)
+	})
+	return keys
+}
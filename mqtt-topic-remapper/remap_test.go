@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// testRemap returns the first remap of config once loaded.
+func testRemap(t *testing.T, config string) Remap {
+	t.Helper()
+	loaded, _ := loadTestConfig(t, config)
+	return loaded.Remaps[0]
+}
+
+// remapTest is a payload remapped by a remap test and the expected result.
+type remapTest struct {
+	payload string
+	want    string
+}
+
+// checkRemap remaps each payload of tests with remap, received on its from.
+func checkRemap(t *testing.T, remap Remap, tests []remapTest) {
+	t.Helper()
+	for _, test := range tests {
+		got, err := remap.remapPayload(remap.From, nil, test.payload)
+		if err != nil {
+			t.Errorf("remapping %q: %s", test.payload, err)
+		} else if got != test.want {
+			t.Errorf("remapping %q: got %q, want %q", test.payload, got, test.want)
+		}
+	}
+}
+
+// captureLogs returns the log entries written through the default logger
+// until the end of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &logs
+}
+
+func TestMatchExact(t *testing.T) {
+	remap := testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+match = "exact"
+message = { on = "ON", off = "OFF" }
+`)
+	checkRemap(t, remap, []remapTest{
+		{"on", "ON"},
+		{"off", "OFF"},
+		// Keys within a word or with other text aren't rewritten.
+		{"button", "button"},
+		{"turn on", "turn on"},
+		{"ON", "ON"},
+		{"", ""},
+	})
+}
+
+func TestMatchSubstring(t *testing.T) {
+	for _, match := range []string{"", `match = "substring"`} {
+		remap := testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+message = { on = "ON" }
+`+match)
+		checkRemap(t, remap, []remapTest{
+			{"on", "ON"},
+			// Every occurrence is replaced, within words too.
+			{"button", "buttON"},
+			{"on and on", "ON and ON"},
+		})
+	}
+}
+
+func TestSubstringReplacementsSinglePass(t *testing.T) {
+	for _, caseInsensitive := range []string{"false", "true"} {
+		remap := testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+message = { a = "b", b = "c", on = "1", online = "2", line = "3" }
+case_insensitive = `+caseInsensitive)
+		checkRemap(t, remap, []remapTest{
+			// Replaced values aren't replaced again.
+			{"ab", "bc"},
+			{"ba", "cb"},
+			// The longest key wins where keys overlap.
+			{"online", "2"},
+			{"on line", "1 3"},
+			{"", ""},
+		})
+	}
+}
+
+func TestMatchCaseInsensitive(t *testing.T) {
+	remap := testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+message = { a = "b", b = "c", on = "ON", online = "Online", "ſ" = "s" }
+case_insensitive = true
+`)
+	checkRemap(t, remap, []remapTest{
+		{"AB", "bc"},
+		{"aB", "bc"},
+		{"turn On", "turn ON"},
+		{"ONLINE or oN", "Online or ON"},
+		// Case is folded like the regexp package does, beyond lowering.
+		{"S", "s"},
+		{"xyz", "xyz"},
+	})
+
+	remap = testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+match = "exact"
+message = { on = "ON" }
+case_insensitive = true
+`)
+	checkRemap(t, remap, []remapTest{
+		{"On", "ON"},
+		{"turn on", "turn on"},
+	})
+}
+
+func TestOrderedReplacementsAreStable(t *testing.T) {
+	// Loaded several times since the order of the map form changed with the
+	// map iteration order before it was sorted.
+	for i := 0; i < 20; i++ {
+		remap := testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+replace = [
+  { from = "a", to = "b" },
+  { from = "b", to = "c" },
+  { from = "on", to = "off" },
+  { from = "online", to = "connected" },
+]
+`)
+		checkRemap(t, remap, []remapTest{
+			// Each replacement applies to the result of the previous ones.
+			{"ab", "cc"},
+			{"ba", "cc"},
+			// "on" is replaced first, so "online" never matches.
+			{"online", "offline"},
+		})
+	}
+
+	remap := testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+replace = [
+  { from = "b", to = "c" },
+  { from = "a", to = "b" },
+]
+`)
+	checkRemap(t, remap, []remapTest{{"ab", "bc"}})
+}
+
+func TestOverlappingKeysWarning(t *testing.T) {
+	for _, test := range []struct {
+		config string
+		warns  bool
+	}{
+		{`message = { on = "1", online = "2" }`, true},
+		{`message = { on = "1", off = "0" }`, false},
+		{`message = { on = "1", online = "2" }
+match = "exact"`, false},
+		{`replace = [{ from = "on", to = "1" }, { from = "online", to = "2" }]`, false},
+	} {
+		logs := captureLogs(t)
+		testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+`+test.config)
+		warned := strings.Contains(logs.String(), "Value mapping keys overlap")
+		if warned != test.warns {
+			t.Errorf("%s: got warning %t, want %t", test.config, warned, test.warns)
+		} else if warned && !strings.Contains(logs.String(), "key=online overlapping_key=on") {
+			t.Errorf("%s: warning doesn't name the keys: %s", test.config, logs)
+		}
+	}
+}
+
+func TestBidirectionalRoundTrip(t *testing.T) {
+	config, _ := loadTestConfig(t, `
+[[remap]]
+from = "command"
+to = "state"
+bidirectional = true
+match = "exact"
+message = { ON = "1", OFF = "0" }
+`)
+	if len(config.Remaps) != 2 {
+		t.Fatalf("got %d remaps, want the remap and its reverse", len(config.Remaps))
+	}
+	forward, reverse := config.Remaps[0], config.Remaps[1]
+	for _, payload := range []string{"ON", "OFF", "unknown"} {
+		state, err := forward.remapPayload(forward.From, nil, payload)
+		if err != nil {
+			t.Fatalf("remapping %q: %s", payload, err)
+		}
+		command, err := reverse.remapPayload(reverse.From, nil, state)
+		if err != nil {
+			t.Fatalf("remapping %q back: %s", state, err)
+		}
+		if command != payload {
+			t.Errorf("%q went out as %q and came back as %q", payload, state, command)
+		}
+	}
+}
+
+func TestBidirectionalIrreversibleOptions(t *testing.T) {
+	for _, option := range []string{
+		"scale = 0.001",
+		"offset = 1.0",
+		`template = '{"value":{{.Payload}}}'`,
+		`default = "unknown"`,
+		`expression = "x * 2"`,
+		`convert = "c_to_f"`,
+		`condition = "value > 0"`,
+		`exec = ["cat"]`,
+		`rename = { a = "b" }`,
+		`json_minify = true`,
+		`batch = "all"`,
+		`decompress = "gzip"`,
+		"base64_encode = true",
+		`timestamp_topic = "/at"`,
+	} {
+		_, err := loadConfig([]string{writeTestConfig(t, `
+[[batch]]
+name = "all"
+to = "batched"
+
+[[remap]]
+from = "command"
+to = "state"
+bidirectional = true
+message = { ON = "1" }
+`+option)})
+		if err == nil || !strings.Contains(err.Error(), "can't be reversed") {
+			t.Errorf("%s: got error %v, want it refused with bidirectional", option, err)
+		}
+	}
+}
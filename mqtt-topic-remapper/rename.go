@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateRename returns the problems found in the rename of r.
+func (r Remap) validateRename() []error {
+	var errs []error
+	renamedFrom := make(map[string]string, len(r.Rename))
+	for _, from := range sortedKeys(r.Rename) {
+		to := r.Rename[from]
+		if from == "" || to == "" {
+			errs = append(errs, fmt.Errorf("remap from %s: invalid rename %q = %q (keys must not be empty)", r.From, from, to))
+		}
+		if other, ok := renamedFrom[to]; ok {
+			errs = append(errs, fmt.Errorf("remap from %s: both %s and %s are renamed to %s", r.From, other, from, to))
+		}
+		renamedFrom[to] = from
+	}
+	return errs
+}
+
+// renameKeys moves the fields of a JSON object payload at the dotted paths
+// of the remap's rename to the dotted paths they map to, creating the objects
+// along the new path as needed. Every field is removed before any is set, so
+// renames can swap keys. Missing fields are skipped, and payloads that aren't
+// JSON objects are returned unchanged.
+func (r Remap) renameKeys(payload string) string {
+	value, err := decodeJSON(payload)
+	if err != nil {
+		r.logger().Debug("Not renaming keys of payload that isn't valid JSON", "from", r.From, "error", err)
+		return payload
+	}
+	document, ok := value.(map[string]any)
+	if !ok {
+		r.logger().Debug("Not renaming keys of payload that isn't a JSON object", "from", r.From)
+		return payload
+	}
+
+	renamed := make(map[string]any, len(r.Rename))
+	for from, to := range r.Rename {
+		if value, ok := removeJSONField(document, from); ok {
+			renamed[to] = value
+		}
+	}
+	for to, value := range renamed {
+		setJSONField(document, to, value)
+	}
+
+	encoded, err := encodeJSON(document)
+	if err != nil {
+		r.logger().Debug("Not renaming keys of payload", "from", r.From, "error", err)
+		return payload
+	}
+	return encoded
+}
+
+// removeJSONField removes the value at the dotted path from a decoded JSON
+// object, returning it and whether it was found.
+func removeJSONField(document map[string]any, path string) (any, bool) {
+	parent, key, found := strings.Cut(path, ".")
+	if !found {
+		value, ok := document[path]
+		delete(document, path)
+		return value, ok
+	}
+	child, ok := document[parent].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	return removeJSONField(child, key)
+}
+
+// setJSONField sets the value at the dotted path in a decoded JSON object,
+// replacing whatever isn't an object along the way.
+func setJSONField(document map[string]any, path string, value any) {
+	parent, key, found := strings.Cut(path, ".")
+	if !found {
+		document[path] = value
+		return
+	}
+	child, ok := document[parent].(map[string]any)
+	if !ok {
+		child = make(map[string]any)
+		document[parent] = child
+	}
+	setJSONField(child, key, value)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// lastValues caches the last message published to each destination topic of
+// the remaps with republish_on_connect, so that they are republished when the
+// remapper (re)connects. It holds at most size topics, forgetting the least
+// recently published ones.
+type lastValues struct {
+	mu       sync.Mutex
+	size     int
+	order    *list.List
+	messages map[string]*list.Element
+}
+
+// cachedMessage is a message of the last values file.
+type cachedMessage struct {
+	Topic     string     `json:"topic"`
+	QoS       byte       `json:"qos"`
+	Retained  bool       `json:"retained"`
+	Payload   []byte     `json:"payload"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newLastValues(size int) *lastValues {
+	return &lastValues{
+		size:     size,
+		order:    list.New(),
+		messages: make(map[string]*list.Element),
+	}
+}
+
+// store records msg as the last message published to its topic.
+func (c *lastValues) store(msg outgoingMessage) {
+	// The processing duration of a republished message isn't meaningful.
+	msg.source, msg.receivedAt = "", time.Time{}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.messages[msg.topic]; ok {
+		element.Value = msg
+		c.order.MoveToBack(element)
+		return
+	}
+	c.messages[msg.topic] = c.order.PushBack(msg)
+	if c.order.Len() > c.size {
+		oldest := c.order.Remove(c.order.Front()).(outgoingMessage)
+		delete(c.messages, oldest.topic)
+	}
+}
+
+// all returns the cached messages, least recently published first.
+func (c *lastValues) all() []outgoingMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	messages := make([]outgoingMessage, 0, c.order.Len())
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		messages = append(messages, element.Value.(outgoingMessage))
+	}
+	return messages
+}
+
+// republish publishes the cached messages with client.
+func (c *lastValues) republish(client mqtt.Client, buffer *offlineBuffer) {
+	messages := c.all()
+	if len(messages) == 0 {
+		return
+	}
+	slog.Info("Republishing last values", "messages", len(messages))
+	for _, msg := range messages {
+		buffer.publishAsync(client, msg)
+	}
+}
+
+// load reads the cached messages saved to path, if it exists.
+func (c *lastValues) load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var messages []cachedMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, msg := range messages {
+		cached := outgoingMessage{topic: msg.Topic, qos: msg.QoS, retained: msg.Retained, payload: string(msg.Payload)}
+		if msg.ExpiresAt != nil {
+			cached.expiresAt = *msg.ExpiresAt
+		}
+		c.store(cached)
+	}
+	slog.Info("Loaded last values", "file", path, "messages", len(messages))
+	return nil
+}
+
+// save writes the cached messages to path, replacing it atomically so that a
+// crash while saving doesn't lose the previous ones.
+func (c *lastValues) save(path string) error {
+	var messages []cachedMessage
+	for _, msg := range c.all() {
+		cached := cachedMessage{Topic: msg.topic, QoS: msg.qos, Retained: msg.retained, Payload: []byte(msg.payload)}
+		if !msg.expiresAt.IsZero() {
+			cached.ExpiresAt = &msg.expiresAt
+		}
+		messages = append(messages, cached)
+	}
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Route is one of the routes of a remap, publishing the payloads that are
+// equal to When (ignoring surrounding whitespace) or meet Condition (see condition for the syntax) to To, which
+// supports the same {1} placeholders as to. A route with neither matches
+// every payload, as the default route.
+type Route struct {
+	When      *string `toml:"when"`
+	Condition string  `toml:"condition"`
+	To        string  `toml:"to"`
+
+	condition *condition
+}
+
+// validateRoutes returns the problems found in the routes of r.
+func (r Remap) validateRoutes() []error {
+	var errs []error
+	if len(r.Routes) > 0 && (len(r.To) > 0 || len(r.Split) > 0 || r.StripPrefix != "" || r.AddPrefix != "") {
+		errs = append(errs, fmt.Errorf("remap from %s: routes can't be used together with to, split, strip_prefix and add_prefix", r.From))
+	}
+	for i, route := range r.Routes {
+		if route.To == "" {
+			errs = append(errs, fmt.Errorf("remap from %s: route %d is missing to", r.From, i+1))
+		}
+		if route.When != nil && route.Condition != "" {
+			errs = append(errs, fmt.Errorf("remap from %s: route %d can't have both when and condition", r.From, i+1))
+		}
+		if route.When == nil && route.Condition == "" && i < len(r.Routes)-1 {
+			errs = append(errs, fmt.Errorf("remap from %s: route %d without when or condition must be the last, the routes after it are never used", r.From, i+1))
+		}
+		if route.To == r.From {
+			errs = append(errs, fmt.Errorf("remap from %s: route %d is to the same topic as from, which would create a loop", r.From, i+1))
+		}
+	}
+	return errs
+}
+
+// compileRoutes parses the conditions of the routes of r.
+func (r *Remap) compileRoutes() error {
+	var errs []error
+	for i := range r.Routes {
+		if r.Routes[i].Condition == "" {
+			continue
+		}
+		condition, err := parseCondition(r.Routes[i].Condition)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("remap from %s: invalid condition %q of route %d: %s", r.From, r.Routes[i].Condition, i+1, err))
+			continue
+		}
+		r.Routes[i].condition = condition
+	}
+	return errors.Join(errs...)
+}
+
+// route returns the destination of the first route payload matches, if any.
+func (r Remap) route(topic string, captures []string, payload string) (Destination, bool) {
+	for _, route := range r.Routes {
+		if route.matches(payload) {
+			return Destination{Topic: expandTopic(route.To, captures)}, true
+		}
+	}
+	r.logger().Debug("No route matches payload", "from", topic, "payload_len", len(payload))
+	countDropped(topic, dropNoRoute)
+	return Destination{}, false
+}
+
+func (route Route) matches(payload string) bool {
+	switch {
+	case route.When != nil:
+		return strings.TrimSpace(payload) == *route.When
+	case route.condition != nil:
+		return route.condition.met(payload)
+	default:
+		return true
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testTimeout bounds every wait of the tests against the embedded broker.
+const testTimeout = 5 * time.Second
+
+// testBroker is an embedded MQTT broker the remapper is run against in
+// process.
+type testBroker struct {
+	t      *testing.T
+	server *mochi.Server
+	addr   string
+	closed sync.Once
+}
+
+// startTestBroker starts a broker listening on a random port, closed at the
+// end of the test.
+func startTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	broker := newTestBroker(t, "")
+	broker.start()
+	return broker
+}
+
+// newTestBroker returns a broker listening on addr, a random port if empty,
+// which accepts connections once started. Subscribing before starting it
+// guarantees the subscriptions receive the messages published as soon as
+// the remapper (re)connects.
+func newTestBroker(t *testing.T, addr string) *testBroker {
+	t.Helper()
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	server := mochi.New(&mochi.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	listener := listeners.NewTCP(listeners.Config{ID: "tcp", Address: addr})
+	if err := server.AddListener(listener); err != nil {
+		t.Fatal(err)
+	}
+	broker := &testBroker{t: t, server: server, addr: listener.Address()}
+	t.Cleanup(broker.close)
+	return broker
+}
+
+func (b *testBroker) start() {
+	go b.server.Serve()
+}
+
+func (b *testBroker) uri() string {
+	return "tcp://" + b.addr
+}
+
+func (b *testBroker) close() {
+	b.closed.Do(func() { b.server.Close() })
+}
+
+// publish publishes a message to the broker as if it was sent by a device.
+func (b *testBroker) publish(topic string, payload string, retained bool, qos byte) {
+	b.t.Helper()
+	if err := b.server.Publish(topic, []byte(payload), retained, qos); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+// subscribe returns the messages published to the broker on the topics
+// matching filter, with the QoS and retained flag they were published with.
+func (b *testBroker) subscribe(filter string) <-chan packets.Packet {
+	b.t.Helper()
+	messages := make(chan packets.Packet, 100)
+	err := b.server.Subscribe(filter, 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		messages <- pk
+	})
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return messages
+}
+
+// waitSubscribed waits until a client other than the test subscribed to a
+// filter matching topic.
+func (b *testBroker) waitSubscribed(topic string) {
+	b.t.Helper()
+	waitFor(b.t, "subscription to "+topic, func() bool {
+		return len(b.server.Topics.Subscribers(topic).Subscriptions) > 0
+	})
+}
+
+// waitFor polls done until it returns true, failing the test after
+// testTimeout.
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitReceived waits until the remapper received count messages on topic in
+// total.
+func waitReceived(t *testing.T, topic string, count int) {
+	t.Helper()
+	waitFor(t, "messages received on "+topic, func() bool {
+		return testutil.ToFloat64(messagesReceived.WithLabelValues(topic)) >= float64(count)
+	})
+}
+
+// receive returns the next message of messages, failing the test if none is
+// published within testTimeout.
+func receive(t *testing.T, messages <-chan packets.Packet) packets.Packet {
+	t.Helper()
+	select {
+	case pk := <-messages:
+		return pk
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for a message")
+		return packets.Packet{}
+	}
+}
+
+// expectMessage fails the test unless the next message of messages is
+// payload published to topic.
+func expectMessage(t *testing.T, messages <-chan packets.Packet, topic string, payload string) packets.Packet {
+	t.Helper()
+	pk := receive(t, messages)
+	if pk.TopicName != topic || string(pk.Payload) != payload {
+		t.Fatalf("got %q on %s, want %q on %s", pk.Payload, pk.TopicName, payload, topic)
+	}
+	return pk
+}
+
+// expectNoMessage fails the test if a message is published within wait.
+func expectNoMessage(t *testing.T, messages <-chan packets.Packet, wait time.Duration) {
+	t.Helper()
+	select {
+	case pk := <-messages:
+		t.Fatalf("got unexpected %q on %s", pk.Payload, pk.TopicName)
+	case <-time.After(wait):
+	}
+}
+
+// writeTestConfig writes config to a TOML file of the test and returns its
+// path.
+func writeTestConfig(t *testing.T, config string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(file, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// loadTestConfig loads config written to a TOML file of the test.
+func loadTestConfig(t *testing.T, config string) (Config, string) {
+	t.Helper()
+	file := writeTestConfig(t, config)
+	loaded, err := loadConfig([]string{file})
+	if err != nil {
+		t.Fatalf("loading config: %s", err)
+	}
+	return loaded, file
+}
+
+// startRemapper runs the remapper with config against the source broker until
+// the returned function is called, which returns the error of run once it
+// has shut down.
+func startRemapper(t *testing.T, source *testBroker, config string) func() error {
+	t.Helper()
+	t.Setenv("METRICS_ADDR", "")
+	loaded, file := loadTestConfig(t, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, loaded, cliFlags{configPath: configPaths{file}, broker: Broker{URI: source.uri()}})
+	}()
+	stopped := false
+	var err error
+	stop := func() error {
+		if !stopped {
+			stopped = true
+			cancel()
+			select {
+			case err = <-done:
+			case <-time.After(testTimeout):
+				t.Fatal("timed out waiting for the remapper to shut down")
+			}
+		}
+		return err
+	}
+	t.Cleanup(func() { stop() })
+	return stop
+}
+
+func TestRunExactRemap(t *testing.T) {
+	broker := startTestBroker(t)
+	messages := broker.subscribe("exact/out")
+	startRemapper(t, broker, `
+[[remap]]
+from = "exact/in"
+to = "exact/out"
+match = "exact"
+message = { ON = "on", OFF = "off" }
+pub_qos = 1
+retained = true
+`)
+	broker.waitSubscribed("exact/in")
+
+	broker.publish("exact/in", "ON", false, 0)
+	pk := expectMessage(t, messages, "exact/out", "on")
+	if pk.FixedHeader.Qos != 1 || !pk.FixedHeader.Retain {
+		t.Errorf("got qos %d and retained %t, want qos 1 retained", pk.FixedHeader.Qos, pk.FixedHeader.Retain)
+	}
+	// An exact remap leaves the payloads that aren't a key unchanged.
+	broker.publish("exact/in", "ONLINE", false, 0)
+	expectMessage(t, messages, "exact/out", "ONLINE")
+}
+
+func TestRunWildcardRemap(t *testing.T) {
+	broker := startTestBroker(t)
+	messages := broker.subscribe("home/#")
+	startRemapper(t, broker, `
+[[remap]]
+from = "zigbee/+/+"
+to = "home/{2}/{1}"
+retain_from_source = true
+
+[[remap]]
+from = "tail/#"
+to = "home/tail/{#}"
+`)
+	broker.waitSubscribed("zigbee/sensor/temperature")
+	broker.waitSubscribed("tail/a")
+
+	broker.publish("zigbee/sensor/temperature", "21.5", false, 0)
+	pk := expectMessage(t, messages, "home/temperature/sensor", "21.5")
+	if pk.FixedHeader.Retain {
+		t.Error("got retained message, want the retained flag of the source message")
+	}
+	broker.publish("tail/a/b/c", "x", false, 0)
+	expectMessage(t, messages, "home/tail/a/b/c", "x")
+}
+
+func TestRunFlushesOfflineBufferOnReconnect(t *testing.T) {
+	source := startTestBroker(t)
+	destination := startTestBroker(t)
+	// A single publisher keeps the buffered messages in order.
+	startRemapper(t, source, `
+buffer_size = 10
+max_inflight = 1
+connect_initial_interval = "100ms"
+connect_max_interval = "200ms"
+
+[destination]
+uri = "`+destination.uri()+`"
+
+[[remap]]
+from = "buffer/in"
+to = "buffer/out"
+pub_qos = 1
+`)
+	source.waitSubscribed("buffer/in")
+
+	destination.close()
+	// Published once the remapper noticed the connection to the destination
+	// broker is lost, which it does as soon as the broker closes it, so they
+	// are buffered until it is back.
+	received := int(testutil.ToFloat64(messagesReceived.WithLabelValues("buffer/in")))
+	time.Sleep(100 * time.Millisecond)
+	for _, payload := range []string{"1", "2", "3"} {
+		source.publish("buffer/in", payload, false, 0)
+	}
+	waitReceived(t, "buffer/in", received+3)
+
+	destination = newTestBroker(t, destination.addr)
+	messages := destination.subscribe("buffer/out")
+	destination.start()
+	for _, payload := range []string{"1", "2", "3"} {
+		expectMessage(t, messages, "buffer/out", payload)
+	}
+}
+
+func TestRunDrainsOnShutdown(t *testing.T) {
+	broker := startTestBroker(t)
+	messages := broker.subscribe("drain/out")
+	stop := startRemapper(t, broker, `
+[[remap]]
+from = "drain/in"
+to = "drain/out"
+debounce = "1h"
+
+[[remap]]
+from = "drain/delayed"
+to = "drain/out"
+delay = "1h"
+`)
+	broker.waitSubscribed("drain/in")
+	broker.waitSubscribed("drain/delayed")
+
+	broker.publish("drain/in", "first", false, 0)
+	broker.publish("drain/in", "last", false, 0)
+	broker.publish("drain/delayed", "delayed", false, 0)
+	waitReceived(t, "drain/in", 2)
+	waitReceived(t, "drain/delayed", 1)
+	expectNoMessage(t, messages, 100*time.Millisecond)
+
+	if err := stop(); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	// The debounced and delayed messages are published before disconnecting.
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		got[string(receive(t, messages).Payload)] = true
+	}
+	if !got["last"] || !got["delayed"] {
+		t.Errorf("got %v published on shutdown, want last and delayed", got)
+	}
+}
+
+func TestRunBidirectionalDoesNotLoop(t *testing.T) {
+	broker := startTestBroker(t)
+	states := broker.subscribe("loop/state")
+	commands := broker.subscribe("loop/command")
+	startRemapper(t, broker, `
+[[remap]]
+from = "loop/command"
+to = "loop/state"
+bidirectional = true
+match = "exact"
+message = { ON = "on", OFF = "off" }
+`)
+	broker.waitSubscribed("loop/command")
+	broker.waitSubscribed("loop/state")
+
+	broker.publish("loop/command", "ON", false, 0)
+	expectMessage(t, commands, "loop/command", "ON")
+	expectMessage(t, states, "loop/state", "on")
+	// The state published by the forward remap isn't remapped back to the
+	// command topic by the reverse one.
+	expectNoMessage(t, commands, 200*time.Millisecond)
+	expectNoMessage(t, states, 0)
+
+	broker.publish("loop/state", "off", false, 0)
+	expectMessage(t, states, "loop/state", "off")
+	expectMessage(t, commands, "loop/command", "OFF")
+	expectNoMessage(t, states, 200*time.Millisecond)
+	expectNoMessage(t, commands, 0)
+}
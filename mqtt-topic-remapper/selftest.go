@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// selftest checks that the remapper can publish to and subscribe from the
+// brokers of config, to catch ACLs silently dropping its messages before
+// they are lost. A unique payload is published to topic and must be received
+// back within the publish timeout, on the source broker and on the
+// destination broker if set. It connects with a generated client ID and a
+// clean session so a running instance and its session are left alone.
+func selftest(ctx context.Context, config Config, flags cliFlags, topic string) error {
+	names := []string{"source"}
+	brokers := []Broker{config.sourceBroker(flags.broker)}
+	if config.Destination != nil {
+		names = append(names, "destination")
+		brokers = append(brokers, *config.Destination)
+	}
+
+	var errs []error
+	for i, broker := range brokers {
+		start := time.Now()
+		if err := roundTrip(ctx, broker, config, topic); err != nil {
+			slog.Error("Self-test failed", "broker", names[i], "topic", topic, "error", err)
+			errs = append(errs, fmt.Errorf("%s broker: %w", names[i], err))
+			continue
+		}
+		slog.Info("Self-test passed", "broker", names[i], "topic", topic, "round_trip", time.Since(start))
+	}
+	return errors.Join(errs...)
+}
+
+// roundTrip connects to broker, subscribes to topic and publishes a unique
+// payload to it, returning once it is received back.
+func roundTrip(ctx context.Context, broker Broker, config Config, topic string) error {
+	broker.ClientID = generateClientID()
+	config.CleanSession = nil
+	opts, err := createClientOptions(broker, config)
+	if err != nil {
+		return fmt.Errorf("creating MQTT client options: %w", err)
+	}
+	opts.SetAutoReconnect(false)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); !token.WaitTimeout(config.ConnectTimeout) {
+		return fmt.Errorf("timed out connecting to MQTT server")
+	} else if err := token.Error(); err != nil {
+		return fmt.Errorf("connecting to MQTT server: %w", err)
+	}
+	defer client.Disconnect(250)
+
+	nonce := make([]byte, 8)
+	_, _ = rand.Read(nonce)
+	payload := "selftest-" + hex.EncodeToString(nonce)
+	received := make(chan struct{}, 1)
+	subscribe := client.Subscribe(topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		if string(msg.Payload()) == payload {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	})
+	if !subscribe.WaitTimeout(config.PublishTimeout) {
+		return fmt.Errorf("timed out subscribing to %s", topic)
+	} else if err := subscribeError(subscribe, topic); err != nil {
+		return fmt.Errorf("subscribing to %s: %w", topic, err)
+	}
+	defer func() {
+		client.Unsubscribe(topic).WaitTimeout(time.Second)
+	}()
+
+	publish := client.Publish(topic, 1, false, payload)
+	if !publish.WaitTimeout(config.PublishTimeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	} else if err := publish.Error(); err != nil {
+		return fmt.Errorf("publishing to %s: %w", topic, err)
+	}
+
+	select {
+	case <-received:
+		return nil
+	case <-time.After(config.PublishTimeout):
+		return fmt.Errorf("published message not received back from %s within %s, the broker may be dropping publishes to it (check its ACL)", topic, config.PublishTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+// target is a message to publish for a remapped message: the payload and the
+// destination it is published to.
+type target struct {
+	destination Destination
+	payload     string
+}
+
+// targets returns the messages to publish for payload, remapped from the
+// received payload on topic: one per destination, with the destination
+// mappings applied, the one of the first route matching the payload with
+// routes, or with split one per field found in the payload.
+func (r Remap) targets(topic string, captures []string, received string, payload string) ([]target, error) {
+	if len(r.Routes) > 0 {
+		destination, ok := r.route(topic, captures, payload)
+		if !ok {
+			return nil, nil
+		}
+		return []target{{destination: destination, payload: payload}}, nil
+	}
+	if len(r.Split) == 0 {
+		destinations, err := r.destinations(topic, captures, received)
+		if err != nil {
+			return nil, err
+		}
+		targets := make([]target, len(destinations))
+		for i, destination := range destinations {
+			targets[i] = target{destination: destination, payload: destination.remap(payload)}
+		}
+		return targets, nil
+	}
+
+	value, err := decodeJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]target, 0, len(r.Split))
+	for _, field := range sortedKeys(r.Split) {
+		fieldValue, ok := lookupJSONField(value, field)
+		if !ok {
+			r.logger().Debug("Skipping split field missing from payload", "from", topic, "field", field)
+			continue
+		}
+		fieldPayload, err := jsonFieldString(fieldValue)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target{
+			destination: Destination{Topic: expandTopic(r.Split[field], captures)},
+			payload:     fieldPayload,
+		})
+	}
+	return targets, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const defaultStalePayload = "unavailable"
+
+// staleWatcher publishes the stale payload of a remap to its stale topic when
+// no message was received on one of its source topics for after, and the
+// fresh payload, if set, once one is received again. Each source topic
+// matched by the wildcards of from has its own timer, started by its first
+// message, while the timer of a from without wildcards is started by start.
+type staleWatcher struct {
+	mu       sync.Mutex
+	after    time.Duration
+	topic    string
+	stale    string
+	fresh    *string
+	qos      byte
+	retained bool
+	log      *slog.Logger
+	publish  func(outgoingMessage)
+	timers   map[string]*staleTimer
+}
+
+type staleTimer struct {
+	timer    *time.Timer
+	captures []string
+	stale    bool
+}
+
+// validateStale returns the problems found in the stale options of r.
+func (r Remap) validateStale() []error {
+	var errs []error
+	if r.StaleAfter < 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid stale_after %s (must be positive)", r.From, r.StaleAfter))
+	}
+	if r.StaleAfter == 0 && (r.StaleTopic != "" || r.StalePayload != nil || r.FreshPayload != nil) {
+		errs = append(errs, fmt.Errorf("remap from %s: stale_topic, stale_payload and fresh_payload require stale_after", r.From))
+	}
+	if r.StaleAfter > 0 && r.StaleTopic == "" {
+		errs = append(errs, fmt.Errorf("remap from %s: stale_after requires stale_topic", r.From))
+	}
+	if r.StaleTopic != "" && r.StaleTopic == r.From {
+		errs = append(errs, fmt.Errorf("remap from %s: stale_topic is the same topic as from, which would create a loop", r.From))
+	}
+	return errs
+}
+
+func newStaleWatcher(r Remap) *staleWatcher {
+	stale := defaultStalePayload
+	if r.StalePayload != nil {
+		stale = *r.StalePayload
+	}
+	return &staleWatcher{
+		after:    r.StaleAfter,
+		topic:    r.StaleTopic,
+		stale:    stale,
+		fresh:    r.FreshPayload,
+		qos:      r.PubQoS,
+		retained: r.Retained,
+		log:      r.logger(),
+		timers:   make(map[string]*staleTimer),
+	}
+}
+
+// start publishes the stale and fresh payloads with publish from now on,
+// starting the timer of from unless it has wildcards.
+func (w *staleWatcher) start(publish func(outgoingMessage), from string, wildcard bool) {
+	w.mu.Lock()
+	w.publish = publish
+	w.mu.Unlock()
+	if !wildcard {
+		w.seen(from, nil)
+	}
+}
+
+// seen restarts the timer of the source topic a message was received on,
+// publishing the fresh payload if it was stale. The payloads are published
+// with the lock held, so that they are queued in order.
+func (w *staleWatcher) seen(topic string, captures []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.publish == nil {
+		// Stopped, or not started yet.
+		return
+	}
+	previous, ok := w.timers[topic]
+	if ok {
+		previous.timer.Stop()
+	}
+	timer := &staleTimer{captures: captures}
+	timer.timer = time.AfterFunc(w.after, func() { w.expire(topic, timer) })
+	w.timers[topic] = timer
+
+	if ok && previous.stale && w.fresh != nil {
+		w.log.Info("Source topic is fresh again", "topic", topic)
+		w.publish(w.message(captures, *w.fresh))
+	}
+}
+
+// expire marks the source topic of timer as stale if no message was received
+// on it since the timer was started.
+func (w *staleWatcher) expire(topic string, timer *staleTimer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timers[topic] != timer || w.publish == nil {
+		return
+	}
+	timer.stale = true
+	w.log.Warn("No message received on source topic, publishing stale payload", "topic", topic, "stale_after", w.after)
+	w.publish(w.message(timer.captures, w.stale))
+}
+
+func (w *staleWatcher) message(captures []string, payload string) outgoingMessage {
+	return outgoingMessage{
+		topic:    expandTopic(w.topic, captures),
+		qos:      w.qos,
+		retained: w.retained,
+		payload:  payload,
+		log:      w.log,
+	}
+}
+
+// stop cancels the timers, used on shutdown and for the remaps replaced by a
+// reload.
+func (w *staleWatcher) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.publish = nil
+	for topic, timer := range w.timers {
+		timer.timer.Stop()
+		delete(w.timers, topic)
+	}
+}
+
+// startStaleWatchers starts the stale watchers of remaps.
+func startStaleWatchers(remaps []Remap, publish func(outgoingMessage)) {
+	for _, remap := range remaps {
+		if remap.staleWatcher != nil {
+			remap.staleWatcher.start(publish, remap.From, remap.FromRegex || isWildcardTopic(remap.From))
+		}
+	}
+}
+
+// stopStaleWatchers stops the stale watchers of remaps.
+func stopStaleWatchers(remaps []Remap) {
+	for _, remap := range remaps {
+		if remap.staleWatcher != nil {
+			remap.staleWatcher.stop()
+		}
+	}
+}
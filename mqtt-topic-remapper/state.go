@@ -0,0 +1,78 @@
+package main
+
+import "container/list"
+
+// maxTopicStates is the number of topics whose state a remap keeps for each
+// of the options tracking the topics separately (rate_limit, dedupe,
+// min_delta, debounce and threshold hysteresis). The least recently used are
+// forgotten first, so that the topics matched by wildcards or rendered from
+// the payload can't grow it without bound.
+const maxTopicStates = 10000
+
+// topicStates holds a state of type V per topic, at most size of them,
+// forgetting the least recently used ones. It isn't safe for concurrent use,
+// its owner holds a lock.
+type topicStates[V any] struct {
+	size   int
+	order  *list.List
+	states map[string]*list.Element
+}
+
+type topicState[V any] struct {
+	topic string
+	value V
+}
+
+func newTopicStates[V any](size int) *topicStates[V] {
+	return &topicStates[V]{size: size, order: list.New(), states: make(map[string]*list.Element)}
+}
+
+// get returns the state of topic, marking it as the most recently used.
+func (s *topicStates[V]) get(topic string) (V, bool) {
+	element, ok := s.states[topic]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	s.order.MoveToBack(element)
+	return element.Value.(*topicState[V]).value, true
+}
+
+// set sets the state of topic, marking it as the most recently used. It
+// returns the state of the least recently used topic if it had to be
+// forgotten to make room.
+func (s *topicStates[V]) set(topic string, value V) (evicted V, ok bool) {
+	if element, found := s.states[topic]; found {
+		element.Value.(*topicState[V]).value = value
+		s.order.MoveToBack(element)
+		return evicted, false
+	}
+	s.states[topic] = s.order.PushBack(&topicState[V]{topic: topic, value: value})
+	if s.order.Len() <= s.size {
+		return evicted, false
+	}
+	oldest := s.order.Remove(s.order.Front()).(*topicState[V])
+	delete(s.states, oldest.topic)
+	return oldest.value, true
+}
+
+// delete forgets the state of topic.
+func (s *topicStates[V]) delete(topic string) {
+	if element, ok := s.states[topic]; ok {
+		s.order.Remove(element)
+		delete(s.states, topic)
+	}
+}
+
+// all returns the states, least recently used first.
+func (s *topicStates[V]) all() []V {
+	values := make([]V, 0, s.order.Len())
+	for element := s.order.Front(); element != nil; element = element.Next() {
+		values = append(values, element.Value.(*topicState[V]).value)
+	}
+	return values
+}
+
+func (s *topicStates[V]) len() int {
+	return s.order.Len()
+}
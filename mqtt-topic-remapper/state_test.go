@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTopicStatesForgetsLeastRecentlyUsed(t *testing.T) {
+	states := newTopicStates[int](2)
+	states.set("a", 1)
+	states.set("b", 2)
+	// a becomes the most recently used one.
+	if value, ok := states.get("a"); !ok || value != 1 {
+		t.Fatalf("got %d, %t for a, want 1", value, ok)
+	}
+	evicted, ok := states.set("c", 3)
+	if !ok || evicted != 2 {
+		t.Errorf("got evicted %d, %t, want the state of b", evicted, ok)
+	}
+	if _, ok := states.get("b"); ok {
+		t.Error("b wasn't forgotten")
+	}
+	if _, ok := states.set("a", 4); ok {
+		t.Error("updating a state evicted another one")
+	}
+	if states.len() != 2 {
+		t.Errorf("got %d states, want 2", states.len())
+	}
+}
+
+func TestRateLimiterPerTopic(t *testing.T) {
+	limiter := newRateLimiter(2, time.Hour)
+	for _, topic := range []string{"a", "b"} {
+		if !limiter.allow(topic) || !limiter.allow(topic) {
+			t.Errorf("denied the first messages to %s", topic)
+		}
+		if limiter.allow(topic) {
+			t.Errorf("allowed a third message to %s", topic)
+		}
+	}
+}
+
+func TestRateLimiterIsBounded(t *testing.T) {
+	limiter := newRateLimiter(1, time.Hour)
+	for i := 0; i < maxTopicStates+10; i++ {
+		limiter.allow(string(rune(i)))
+	}
+	if limiter.buckets.len() != maxTopicStates {
+		t.Errorf("got %d buckets, want %d", limiter.buckets.len(), maxTopicStates)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// templateData is the data a remap template is rendered with.
+type templateData struct {
+	// Topic is the topic the message was received on.
+	Topic string
+	// Captures are the topic levels matched by the "+" wildcards of from,
+	// followed by those matched by its "#" wildcard joined with "/".
+	Captures []string
+	// Payload is the remapped payload.
+	Payload string
+	// JSON is the payload parsed as JSON, or nil if it isn't valid JSON.
+	JSON any
+}
+
+func renderTemplate(tmpl *template.Template, topic string, captures []string, payload string) (string, error) {
+	data := templateData{Topic: topic, Captures: captures, Payload: payload}
+	if value, err := decodeJSON(payload); err == nil {
+		data.JSON = value
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("failed to render template: %s", err)
+	}
+	return out.String(), nil
+}
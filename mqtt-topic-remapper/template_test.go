@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestTemplate(t *testing.T) {
+	remap := testRemap(t, `
+[[remap]]
+from = "sensors/+/#"
+to = "out"
+template = '{{.Topic}} {{index .Captures 0}} {{index .Captures 1}}: {{.Payload}}{{with .JSON}} ({{.temp}}){{end}}'
+`)
+	for _, test := range []struct {
+		topic   string
+		payload string
+		want    string
+	}{
+		{"sensors/kitchen/temp/1", `{"temp":21.5}`, `sensors/kitchen/temp/1 kitchen temp/1: {"temp":21.5} (21.5)`},
+		// JSON is nil when the payload isn't JSON.
+		{"sensors/hall/x", "on", "sensors/hall/x hall x: on"},
+	} {
+		captures, _ := remap.matchTopic(test.topic)
+		got, err := remap.remapPayload(test.topic, captures, test.payload)
+		if err != nil {
+			t.Errorf("rendering %q: %s", test.payload, err)
+		} else if got != test.want {
+			t.Errorf("rendering %q: got %q, want %q", test.payload, got, test.want)
+		}
+	}
+}
+
+func TestTemplateMissingKey(t *testing.T) {
+	remap := testRemap(t, `
+[[remap]]
+from = "in"
+to = "out"
+template = '{{.JSON.temp}}'
+`)
+	checkRemap(t, remap, []remapTest{{`{"temp":21.5}`, "21.5"}})
+	if got, err := remap.remapPayload(remap.From, nil, `{"humidity":50}`); err == nil {
+		t.Errorf("got %q, want an error for the missing key", got)
+	}
+}
+
+func TestTopicTemplate(t *testing.T) {
+	remap := testRemap(t, `
+[[remap]]
+from = "zigbee/+"
+to = "home/{{.room}}/{1}"
+`)
+	for _, test := range []struct {
+		payload string
+		want    string
+	}{
+		{`{"room":"kitchen"}`, "home/kitchen/lamp"},
+		{`{"room":""}`, ""},
+		{`{"room":"a/+"}`, ""},
+		{`{"other":"kitchen"}`, ""},
+		{`["kitchen"]`, ""},
+	} {
+		destinations, err := remap.destinations("zigbee/lamp", []string{"lamp"}, test.payload)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("rendering %s: got %v, want an error", test.payload, destinations)
+		case test.want != "" && err != nil:
+			t.Errorf("rendering %s: %s", test.payload, err)
+		case test.want != "" && destinations[0].Topic != test.want:
+			t.Errorf("rendering %s: got %s, want %s", test.payload, destinations[0].Topic, test.want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Threshold turns a numeric payload into one of two states: Above when it is
+// greater than Value and Below when it is lower. Values equal to Value are
+// mapped to Equal if set, and to Above otherwise.
+//
+// High and Low add hysteresis instead of Value, for readings hovering around
+// the cutoff: the state only becomes Above once the value rises above High
+// and Below once it falls below Low, staying the same in between. The state
+// is tracked per source topic, for up to maxTopicStates topics, and values
+// between the bounds are compared with their middle until one is known.
+type Threshold struct {
+	Value *float64 `toml:"value"`
+	High  *float64 `toml:"high"`
+	Low   *float64 `toml:"low"`
+	Above string   `toml:"above"`
+	Below string   `toml:"below"`
+	Equal *string  `toml:"equal"`
+
+	states *hysteresis
+}
+
+// hysteresis holds the state of a threshold with hysteresis per source topic,
+// counting the flaps it suppressed as those of remap.
+type hysteresis struct {
+	mu    sync.Mutex
+	remap string
+	above *topicStates[bool]
+}
+
+// validate returns the problems found in the threshold of the remap from.
+func (t Threshold) validate(from string) []error {
+	var errs []error
+	switch {
+	case t.Value != nil && (t.High != nil || t.Low != nil):
+		errs = append(errs, fmt.Errorf("remap from %s: threshold value can't be used together with high and low", from))
+	case t.High != nil && t.Low != nil:
+		if *t.Low >= *t.High {
+			errs = append(errs, fmt.Errorf("remap from %s: threshold low %g must be lower than high %g", from, *t.Low, *t.High))
+		}
+		if t.Equal != nil {
+			errs = append(errs, fmt.Errorf("remap from %s: threshold equal can't be used together with high and low", from))
+		}
+	case t.High != nil || t.Low != nil:
+		errs = append(errs, fmt.Errorf("remap from %s: threshold requires both high and low", from))
+	case t.Value == nil:
+		errs = append(errs, fmt.Errorf("remap from %s: threshold is missing value (or high and low)", from))
+	}
+	if t.Above == "" || t.Below == "" {
+		errs = append(errs, fmt.Errorf("remap from %s: threshold requires both above and below", from))
+	}
+	return errs
+}
+
+// compile sets up the per topic state of a threshold with hysteresis of the
+// remap tagged remap.
+func (t *Threshold) compile(remap string) {
+	if t.High != nil {
+		t.states = &hysteresis{remap: remap, above: newTopicStates[bool](maxTopicStates)}
+	}
+}
+
+// apply parses payload, received on topic, as a number and returns the state
+// it is in.
+func (t Threshold) apply(topic string, payload string) (string, error) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(payload), 64)
+	if err != nil {
+		return "", fmt.Errorf("payload %q is not a number", payload)
+	}
+	if t.states != nil {
+		if t.states.update(topic, value, *t.High, *t.Low) {
+			return t.Above, nil
+		}
+		return t.Below, nil
+	}
+	switch {
+	case value > *t.Value:
+		return t.Above, nil
+	case value < *t.Value:
+		return t.Below, nil
+	case t.Equal != nil:
+		return *t.Equal, nil
+	default:
+		return t.Above, nil
+	}
+}
+
+// update records value received on topic and reports whether topic is now
+// above the threshold, counting the flaps the band between low and high
+// suppressed: values between them on the other side of its middle.
+func (h *hysteresis) update(topic string, value float64, high float64, low float64) bool {
+	middle := (high + low) / 2
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	above, known := h.above.get(topic)
+	switch {
+	case value > high:
+		above = true
+	case value < low:
+		above = false
+	case !known:
+		above = value >= middle
+	case above != (value >= middle):
+		thresholdFlapsSuppressed.WithLabelValues(h.remap).Inc()
+	}
+	h.above.set(topic, above)
+	return above
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHysteresisUpdate(t *testing.T) {
+	states := &hysteresis{remap: "test hysteresis", above: newTopicStates[bool](maxTopicStates)}
+	flaps := thresholdFlapsSuppressed.WithLabelValues("test hysteresis")
+	for _, test := range []struct {
+		topic string
+		value float64
+		above bool
+		flap  bool
+	}{
+		// Compared with the middle of the band until the state is known.
+		{"a", 22, true, false},
+		{"b", 21.9, false, false},
+		{"a", 20.5, true, true},
+		{"a", 19, false, false},
+		{"a", 22.5, false, true},
+		{"a", 21, false, false},
+		{"a", 25, true, false},
+		{"b", 24, false, true},
+	} {
+		before := testutil.ToFloat64(flaps)
+		if got := states.update(test.topic, test.value, 24, 20); got != test.above {
+			t.Errorf("%g on %s: got above %t, want %t", test.value, test.topic, got, test.above)
+		}
+		if flapped := testutil.ToFloat64(flaps) > before; flapped != test.flap {
+			t.Errorf("%g on %s: got flap counted %t, want %t", test.value, test.topic, flapped, test.flap)
+		}
+	}
+}
+
+func TestHysteresisIsBounded(t *testing.T) {
+	states := &hysteresis{above: newTopicStates[bool](2)}
+	states.update("a", 25, 24, 20)
+	states.update("b", 25, 24, 20)
+	states.update("c", 25, 24, 20)
+	// a was forgotten, so its state is compared with the middle again.
+	if states.update("a", 21, 24, 20) {
+		t.Error("kept the state of a forgotten topic")
+	}
+}
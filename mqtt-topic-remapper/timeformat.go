@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	timeEpochSeconds = "epoch_s"
+	timeEpochMillis  = "epoch_ms"
+)
+
+// TimeFormat reformats a timestamp from the From layout to the To layout,
+// e.g. from the epoch milliseconds of a device to the RFC 3339 Home Assistant
+// expects. The layouts are "epoch_s", "epoch_ms", "rfc3339" or a Go reference
+// layout such as "2006-01-02 15:04:05". The whole payload is reformatted
+// unless Field sets the dotted path of the timestamp in a JSON object
+// payload, the rest of which is published unchanged.
+//
+// Timezone is the IANA name of the zone (e.g. "Europe/Lisbon") the
+// timestamps are formatted in, and the one those parsed with a layout without
+// a zone are assumed to be in. It defaults to the local zone of the remapper.
+type TimeFormat struct {
+	From     string `toml:"from"`
+	To       string `toml:"to"`
+	Field    string `toml:"field"`
+	Timezone string `toml:"timezone"`
+
+	location *time.Location
+}
+
+// validate returns the problems found in the time format of the remap from.
+func (f TimeFormat) validate(from string) []error {
+	var errs []error
+	if f.From == "" || f.To == "" {
+		errs = append(errs, fmt.Errorf("remap from %s: time_format requires both from and to", from))
+	}
+	for _, layout := range []string{f.From, f.To} {
+		if layout != "" && !validTimeLayout(layout) {
+			errs = append(errs, fmt.Errorf("remap from %s: invalid time_format layout %q (must be %s, %s, %s or a Go reference layout such as \"2006-01-02 15:04:05\")", from, layout, timeEpochSeconds, timeEpochMillis, timestampRFC3339))
+		}
+	}
+	return errs
+}
+
+// validTimeLayout reports whether layout is one of the named layouts, or a
+// Go layout referencing at least one element of the reference time, unlike a
+// misspelt name: formatting a time differing from the reference time in
+// every element changes it.
+func validTimeLayout(layout string) bool {
+	switch layout {
+	case timeEpochSeconds, timeEpochMillis, timestampRFC3339:
+		return true
+	}
+	sample := time.Date(2011, time.March, 13, 8, 19, 27, 123456789, time.FixedZone("CET", 60*60))
+	return sample.Format(layout) != layout
+}
+
+// compile loads the timezone of the time format.
+func (f *TimeFormat) compile(from string) error {
+	f.location = time.Local
+	if f.Timezone == "" {
+		return nil
+	}
+	location, err := time.LoadLocation(f.Timezone)
+	if err != nil {
+		return fmt.Errorf("remap from %s: invalid time_format timezone %q: %s", from, f.Timezone, err)
+	}
+	f.location = location
+	return nil
+}
+
+// apply reformats the timestamp payload, or the timestamp at the field of a
+// JSON object payload. An error means the timestamp couldn't be parsed and
+// the message should be dropped.
+func (f TimeFormat) apply(payload string) (string, error) {
+	if f.Field == "" {
+		t, err := f.parse(payload)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprint(f.format(t)), nil
+	}
+
+	value, err := decodeJSON(payload)
+	if err != nil {
+		return "", err
+	}
+	document, ok := value.(map[string]any)
+	if !ok {
+		return "", fmt.Errorf("payload is not a JSON object")
+	}
+	field, ok := lookupJSONField(document, f.Field)
+	if !ok {
+		return "", fmt.Errorf("field %s not found in payload", f.Field)
+	}
+	timestamp, err := jsonFieldString(field)
+	if err != nil {
+		return "", err
+	}
+	t, err := f.parse(timestamp)
+	if err != nil {
+		return "", err
+	}
+	setJSONField(document, f.Field, f.format(t))
+	return encodeJSON(document)
+}
+
+// parse parses timestamp with the from layout.
+func (f TimeFormat) parse(timestamp string) (time.Time, error) {
+	timestamp = strings.TrimSpace(timestamp)
+	switch f.From {
+	case timeEpochSeconds, timeEpochMillis:
+		// Integers are parsed as such so that large ones keep their precision.
+		if epoch, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+			if f.From == timeEpochMillis {
+				return time.UnixMilli(epoch), nil
+			}
+			return time.Unix(epoch, 0), nil
+		}
+		epoch, err := strconv.ParseFloat(timestamp, 64)
+		if err != nil || math.IsNaN(epoch) || math.IsInf(epoch, 0) {
+			return time.Time{}, fmt.Errorf("timestamp %q is not a number of %s", timestamp, f.From)
+		}
+		if f.From == timeEpochMillis {
+			epoch /= 1000
+		}
+		seconds, fraction := math.Modf(epoch)
+		return time.Unix(int64(seconds), int64(fraction*1e9)), nil
+	}
+	t, err := time.ParseInLocation(f.layout(f.From), timestamp, f.location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timestamp %q doesn't match layout %s: %s", timestamp, f.From, err)
+	}
+	return t, nil
+}
+
+// format formats t with the to layout. Epoch timestamps are returned as
+// numbers so they are encoded as such in JSON.
+func (f TimeFormat) format(t time.Time) any {
+	switch f.To {
+	case timeEpochSeconds:
+		return json.Number(strconv.FormatInt(t.Unix(), 10))
+	case timeEpochMillis:
+		return json.Number(strconv.FormatInt(t.UnixMilli(), 10))
+	}
+	return t.In(f.location).Format(f.layout(f.To))
+}
+
+// layout returns the Go layout of a layout that isn't an epoch.
+func (f TimeFormat) layout(layout string) string {
+	if layout == timestampRFC3339 {
+		return time.RFC3339
+	}
+	return layout
+}
@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+// testTimeFormat returns the time format from from to to, in timezone.
+func testTimeFormat(t *testing.T, from string, to string, timezone string) TimeFormat {
+	t.Helper()
+	format := TimeFormat{From: from, To: to, Timezone: timezone}
+	if errs := format.validate("test"); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if err := format.compile("test"); err != nil {
+		t.Fatal(err)
+	}
+	return format
+}
+
+func TestTimeFormat(t *testing.T) {
+	for _, test := range []struct {
+		from, to, timezone string
+		timestamp          string
+		want               string
+	}{
+		{"epoch_ms", "rfc3339", "UTC", "1700000000123", "2023-11-14T22:13:20Z"},
+		{"epoch_s", "rfc3339", "Europe/Lisbon", " 1700000000 ", "2023-11-14T22:13:20Z"},
+		{"epoch_s", "rfc3339", "Europe/Lisbon", "1688212800", "2023-07-01T13:00:00+01:00"},
+		{"epoch_s", "epoch_ms", "", "1700000000.25", "1700000000250"},
+		{"epoch_ms", "epoch_s", "", "1700000000999", "1700000000"},
+		// Large integers keep their precision.
+		{"epoch_ms", "epoch_ms", "", "9007199254740993", "9007199254740993"},
+		{"rfc3339", "epoch_s", "", "2023-11-14T23:13:20+01:00", "1700000000"},
+		// Layouts without a zone are in the timezone.
+		{"2006-01-02 15:04:05", "rfc3339", "Europe/Lisbon", "2023-07-01 12:00:00", "2023-07-01T12:00:00+01:00"},
+		{"2006-01-02 15:04:05", "epoch_s", "UTC", "2023-11-14 22:13:20", "1700000000"},
+		{"epoch_s", "02/01/2006 15:04", "UTC", "1700000000", "14/11/2023 22:13"},
+	} {
+		format := testTimeFormat(t, test.from, test.to, test.timezone)
+		got, err := format.apply(test.timestamp)
+		if err != nil {
+			t.Errorf("%s to %s of %q: %s", test.from, test.to, test.timestamp, err)
+		} else if got != test.want {
+			t.Errorf("%s to %s of %q: got %q, want %q", test.from, test.to, test.timestamp, got, test.want)
+		}
+	}
+}
+
+func TestTimeFormatInvalidTimestamps(t *testing.T) {
+	for _, test := range []struct{ from, timestamp string }{
+		{"epoch_s", "yesterday"},
+		{"epoch_ms", "NaN"},
+		{"epoch_s", "+Inf"},
+		{"rfc3339", "2023-11-14 22:13:20"},
+		{"2006-01-02", "14/11/2023"},
+	} {
+		format := testTimeFormat(t, test.from, "rfc3339", "UTC")
+		if got, err := format.apply(test.timestamp); err == nil {
+			t.Errorf("%s of %q: got %q, want an error", test.from, test.timestamp, got)
+		}
+	}
+}
+
+func TestTimeFormatField(t *testing.T) {
+	format := testTimeFormat(t, "epoch_s", "rfc3339", "UTC")
+	format.Field = "state.at"
+	got, err := format.apply(`{"state":{"at":1700000000,"on":true}}`)
+	if want := `{"state":{"at":"2023-11-14T22:13:20Z","on":true}}`; err != nil || got != want {
+		t.Errorf("got %q, %v, want %q", got, err, want)
+	}
+	// Epoch timestamps are written back as numbers.
+	format = testTimeFormat(t, "rfc3339", "epoch_ms", "UTC")
+	format.Field = "at"
+	got, err = format.apply(`{"at":"2023-11-14T22:13:20Z"}`)
+	if want := `{"at":1700000000000}`; err != nil || got != want {
+		t.Errorf("got %q, %v, want %q", got, err, want)
+	}
+	for _, payload := range []string{`{"other":1}`, `[1700000000]`, `not json`} {
+		if got, err := format.apply(payload); err == nil {
+			t.Errorf("%s: got %q, want an error", payload, got)
+		}
+	}
+}
+
+func TestValidTimeLayout(t *testing.T) {
+	for layout, want := range map[string]bool{
+		"epoch_s":             true,
+		"epoch_ms":            true,
+		"rfc3339":             true,
+		"2006-01-02 15:04:05": true,
+		"15:04":               true,
+		"unix":                false,
+		"epoch":               false,
+	} {
+		if got := validTimeLayout(layout); got != want {
+			t.Errorf("%q: got valid %t, want %t", layout, got, want)
+		}
+	}
+}
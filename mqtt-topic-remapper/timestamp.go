@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	timestampRFC3339 = "rfc3339"
+	timestampUnix    = "unix"
+	timestampUnixMs  = "unix_ms"
+)
+
+// formatTimestamp formats t as configured by the remap's timestamp_format.
+// Epoch timestamps are returned as numbers so they are encoded as such in JSON.
+func (r Remap) formatTimestamp(t time.Time) any {
+	switch r.TimestampFormat {
+	case timestampUnix:
+		return t.Unix()
+	case timestampUnixMs:
+		return t.UnixMilli()
+	default:
+		return t.Format(time.RFC3339)
+	}
+}
+
+// timestampPayload returns the timestamp published to the timestamp topic.
+func (r Remap) timestampPayload(t time.Time) string {
+	return fmt.Sprint(r.formatTimestamp(t))
+}
+
+// injectTimestamp sets the timestamp field of a JSON object payload. Payloads
+// that aren't JSON objects are returned unchanged, with ok set to false.
+func (r Remap) injectTimestamp(payload string, t time.Time) (string, bool) {
+	value, err := decodeJSON(payload)
+	if err != nil {
+		return payload, false
+	}
+	object, ok := value.(map[string]any)
+	if !ok {
+		return payload, false
+	}
+
+	object[r.TimestampField] = r.formatTimestamp(t)
+	encoded, err := encodeJSON(object)
+	if err != nil {
+		return payload, false
+	}
+	return encoded, true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func isWildcardTopic(topic string) bool {
+	return strings.ContainsAny(topic, "+#")
+}
+
+// topicMatches reports whether topic matches the MQTT subscription pattern,
+// following the "+" (single level) and "#" (remaining levels, including none)
+// wildcard rules.
+func topicMatches(pattern string, topic string) bool {
+	_, ok := matchTopic(pattern, topic)
+	return ok
+}
+
+// matchTopic reports whether topic matches the MQTT subscription pattern and
+// returns the levels captured by each "+" wildcard, in order, followed by the
+// levels matched by a "#" wildcard joined with "/" (empty if it matched none).
+func matchTopic(pattern string, topic string) ([]string, bool) {
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	var captures []string
+	for i, level := range patternLevels {
+		if level == "#" {
+			tail := ""
+			if i < len(topicLevels) {
+				tail = strings.Join(topicLevels[i:], "/")
+			}
+			return append(captures, tail), true
+		}
+		if i >= len(topicLevels) {
+			return nil, false
+		}
+		if level == "+" {
+			captures = append(captures, topicLevels[i])
+		} else if level != topicLevels[i] {
+			return nil, false
+		}
+	}
+
+	return captures, len(patternLevels) == len(topicLevels)
+}
+
+// expandTopic replaces the {1}, {2}, ... placeholders in topic with the
+// corresponding captured wildcard levels, and {#} with the levels matched by
+// the "#" wildcard, which are the last capture. validateCaptures makes sure
+// the placeholders only reference the captures of from.
+func expandTopic(topic string, captures []string) string {
+	if len(captures) == 0 {
+		return topic
+	}
+	replacements := make([]string, 0, len(captures)*2+2)
+	for i, capture := range captures {
+		replacements = append(replacements, "{"+strconv.Itoa(i+1)+"}", capture)
+	}
+	replacements = append(replacements, "{#}", captures[len(captures)-1])
+	return strings.NewReplacer(replacements...).Replace(topic)
+}
+
+// capturePlaceholder matches the {1} and {#} placeholders of a topic.
+var capturePlaceholder = regexp.MustCompile(`\{([0-9]+|#)\}`)
+
+// validateCaptures returns the problems found in the placeholders of the
+// topics of r: they must reference a "+" wildcard level (or a capture group
+// with from_regex) of from, and {#} requires from to end with "#".
+func (r Remap) validateCaptures() []error {
+	var captures int
+	var tail bool
+	kind := "wildcard levels"
+	if r.FromRegex {
+		regex, err := regexp.Compile("^(?:" + r.From + ")$")
+		if err != nil {
+			// Reported when the remap is compiled.
+			return nil
+		}
+		captures, kind = regex.NumSubexp(), "capture groups"
+	} else {
+		levels := strings.Split(r.From, "/")
+		for _, level := range levels {
+			if level == "+" {
+				captures++
+			}
+		}
+		tail = levels[len(levels)-1] == "#"
+	}
+
+	var errs []error
+	check := func(option string, topic string) {
+		for _, match := range capturePlaceholder.FindAllStringSubmatch(topic, -1) {
+			if match[1] == "#" {
+				if !tail {
+					errs = append(errs, fmt.Errorf("remap from %s: %s %s references {#}, but from doesn't end with the # wildcard", r.From, option, topic))
+				}
+				continue
+			}
+			if n, err := strconv.Atoi(match[1]); err != nil || n < 1 || n > captures {
+				errs = append(errs, fmt.Errorf("remap from %s: %s %s references %s, but from only has %d %s", r.From, option, topic, match[0], captures, kind))
+			}
+		}
+	}
+	for _, destination := range r.To {
+		check("to", destination.Topic)
+	}
+	for _, field := range sortedKeys(r.Split) {
+		check("split", r.Split[field])
+	}
+	for _, route := range r.Routes {
+		check("route to", route.To)
+	}
+	check("else_to", r.ElseTo)
+	check("batch_key", r.BatchKey)
+	check("merge_field", r.MergeField)
+	check("stale_topic", r.StaleTopic)
+	return errs
+}
+
+// remapTable resolves incoming topics to the remap responsible for them.
+//
+// Matching precedence: a remap whose "from" equals the topic exactly always
+// wins. Otherwise, wildcard and from_regex remaps are tried in the order they
+// appear in the config file and the first one that matches is used.
+type remapTable struct {
+	remaps   []Remap
+	exact    map[string]Remap
+	wildcard []Remap
+}
+
+func newRemapTable(remaps []Remap) remapTable {
+	table := remapTable{remaps: remaps, exact: make(map[string]Remap)}
+	for _, remap := range remaps {
+		if remap.FromRegex || isWildcardTopic(remap.From) {
+			table.wildcard = append(table.wildcard, remap)
+		} else {
+			table.exact[remap.From] = remap
+		}
+	}
+	return table
+}
+
+func (t remapTable) find(topic string) (Remap, []string, bool) {
+	if remap, ok := t.exact[topic]; ok {
+		return remap, nil, true
+	}
+	for _, remap := range t.wildcard {
+		if captures, ok := remap.matchTopic(topic); ok {
+			return remap, captures, true
+		}
+	}
+	return Remap{}, nil, false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTopicMatches(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"home/kitchen/temp", "home/kitchen/temp", true},
+		{"home/kitchen/temp", "home/kitchen", false},
+		{"home/kitchen", "home/kitchen/temp", false},
+		// + matches exactly one level, empty ones included.
+		{"home/+/temp", "home/kitchen/temp", true},
+		{"home/+/temp", "home//temp", true},
+		{"home/+/temp", "home/kitchen/sink/temp", false},
+		{"home/+/temp", "home/temp", false},
+		{"+/+", "home/kitchen", true},
+		{"+", "home/kitchen", false},
+		// # matches the remaining levels, the parent level included.
+		{"home/#", "home/kitchen/temp", true},
+		{"home/#", "home/kitchen", true},
+		{"home/#", "home", true},
+		{"home/#", "homes/kitchen", false},
+		{"#", "home/kitchen/temp", true},
+		{"home/+/#", "home/kitchen/temp/1", true},
+		{"home/+/#", "home/kitchen", true},
+		{"home/+/#", "home", false},
+	} {
+		if got := topicMatches(test.pattern, test.topic); got != test.want {
+			t.Errorf("%s matching %s: got %t, want %t", test.pattern, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestMatchTopicCaptures(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		topic   string
+		want    []string
+	}{
+		{"zigbee/+/+", "zigbee/sensor/temperature", []string{"sensor", "temperature"}},
+		{"tail/#", "tail/a/b/c", []string{"a/b/c"}},
+		{"tail/+/#", "tail/a/b/c", []string{"a", "b/c"}},
+		{"tail/#", "tail", []string{""}},
+		{"exact", "exact", nil},
+	} {
+		got, ok := matchTopic(test.pattern, test.topic)
+		if !ok || !slices.Equal(got, test.want) {
+			t.Errorf("%s matching %s: got %q, %t, want %q", test.pattern, test.topic, got, ok, test.want)
+		}
+	}
+}
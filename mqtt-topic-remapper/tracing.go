@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the handled messages. It is a no-op until
+// startTracing sets the global tracer provider.
+var tracer = otel.Tracer("smart-home-system/mqtt-topic-remapper")
+
+// tracingEnabled reports whether an OTLP exporter is configured by the
+// standard OTEL_* environment variables.
+func tracingEnabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// startTracing exports the spans of the handled messages over OTLP/HTTP, as
+// configured by the OTEL_* environment variables, if an endpoint is set. The
+// returned function flushes the pending spans and stops the exporter.
+func startTracing(ctx context.Context) (func(), error) {
+	if !tracingEnabled() {
+		return func() {}, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP trace exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.NewSchemaless(semconv.ServiceName("mqtt-topic-remapper")), resource.Default())
+	if err != nil {
+		return nil, fmt.Errorf("creating trace resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	slog.Info("Exporting traces over OTLP")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Error("Error stopping trace exporter", "error", err)
+		}
+	}, nil
+}
+
+// startMessageSpan starts the span of a message received on topic.
+func startMessageSpan(topic string) trace.Span {
+	_, span := tracer.Start(context.Background(), "remap", trace.WithSpanKind(trace.SpanKindConsumer))
+	if span.IsRecording() {
+		span.SetAttributes(semconv.MessagingSystemKey.String("mqtt"), semconv.MessagingDestinationName(topic))
+	}
+	return span
+}
+
+// traceRemap adds the remap handling a message and its transform steps to
+// span.
+func traceRemap(span trace.Span, remap Remap) {
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(attribute.String("remap.from", remap.From), attribute.StringSlice("remap.transform", remap.transformSteps()))
+}
+
+// traceTargets adds the topics a message is published to to span.
+func traceTargets(span trace.Span, targets []target) {
+	if !span.IsRecording() {
+		return
+	}
+	topics := make([]string, len(targets))
+	for i, target := range targets {
+		topics[i] = target.destination.Topic
+	}
+	span.SetAttributes(attribute.StringSlice("remap.to", topics))
+}
+
+// transformSteps returns the payload transforms of r, including those of its
+// pipeline steps and destinations, in the order they are applied: by
+// remapPayload, then by the destinations and on publish.
+func (r Remap) transformSteps() []string {
+	var steps []string
+	add := func(name string, set bool) {
+		if set {
+			steps = append(steps, name)
+		}
+	}
+	add("decompress", r.Decompress != "")
+	add("base64_encode", r.Base64Encode)
+	steps = append(steps, r.remapSteps("")...)
+	add("base64_decode", r.Base64Decode)
+	for _, destination := range r.To {
+		add("message in to "+destination.Topic, len(destination.ValueMappings) > 0)
+	}
+	add("timestamp_field", r.TimestampField != "")
+	add("compress", r.Compress != "")
+	return steps
+}
+
+// remapSteps returns the transforms applied by remap, each prefixed with
+// prefix, in the order they are applied.
+func (r Remap) remapSteps(prefix string) []string {
+	var steps []string
+	add := func(name string, set bool) {
+		if set {
+			steps = append(steps, prefix+name)
+		}
+	}
+	add("condition", r.Condition != "")
+	add("schema", r.Schema != "")
+	add("field", r.Field != "")
+	add("time_format", r.TimeFormat != nil)
+	add("jsonpath", r.JSONPath != "")
+	add("expression", r.Expression != "")
+	add("convert", r.Convert != "")
+	add("scale, offset, decimals, round or format", r.Scale != nil || r.Offset != nil || r.Decimals != nil || r.Round != nil || r.Format != "")
+	add("threshold", r.Threshold != nil)
+	add("invert", r.Invert)
+	add("default or drop_unmatched", r.Default != nil || r.DropUnmatched)
+	add("message", len(r.ValueMappings) > 0)
+	add("replace", len(r.Replacements) > 0)
+	add("rename", len(r.Rename) > 0)
+	add("exec", len(r.Exec) > 0)
+	add("json_minify or json_pretty", r.JSONMinify || r.JSONPretty)
+	add("allow_values, deny_values, min or max", len(r.AllowValues) > 0 || len(r.DenyValues) > 0 || r.Min != nil || r.Max != nil)
+	add("template", r.Template != "")
+	for i, step := range r.Pipeline {
+		steps = append(steps, step.remapSteps(fmt.Sprintf("%spipeline step %d ", prefix, i+1))...)
+	}
+	return steps
+}
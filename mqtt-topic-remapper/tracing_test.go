@@ -0,0 +1,46 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTransformSteps(t *testing.T) {
+	remap := testRemap(t, `
+[[batch]]
+name = "all"
+to = "batched"
+
+[[remap]]
+from = "a"
+template = '{"value":{{.Payload}}}'
+scale = 0.1
+field = "value"
+condition = "value > 0"
+decompress = "gzip"
+compress = "gzip"
+batch = "all"
+timestamp_field = "at"
+
+[[remap.to]]
+topic = "b"
+message = { "1" = "one" }
+
+[[remap.pipeline]]
+message = { a = "b" }
+`)
+	want := []string{
+		"decompress",
+		"condition",
+		"field",
+		"scale, offset, decimals, round or format",
+		"template",
+		"pipeline step 1 message",
+		"message in to b",
+		"timestamp_field",
+		"compress",
+	}
+	if got := remap.transformSteps(); !slices.Equal(got, want) {
+		t.Errorf("got transform steps %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// decodeJSON parses payload as JSON, keeping numbers as json.Number so they are
+// re-encoded exactly as received.
+func decodeJSON(payload string) (any, error) {
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("payload is not valid JSON: %s", err)
+	}
+	return value, nil
+}
+
+// extractJSONField parses payload as JSON and returns the value found at the
+// dotted path (e.g. "sensor.temperature"). Strings are returned unquoted, any
+// other value is returned encoded as JSON.
+func extractJSONField(payload string, path string) (string, error) {
+	value, err := decodeJSON(payload)
+	if err != nil {
+		return "", err
+	}
+	field, ok := lookupJSONField(value, path)
+	if !ok {
+		return "", fmt.Errorf("field %s not found in payload", path)
+	}
+	return jsonFieldString(field)
+}
+
+// lookupJSONField returns the value at the dotted path in a decoded JSON
+// value, reporting whether it was found.
+func lookupJSONField(value any, path string) (any, bool) {
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// jsonFieldString returns strings unquoted and any other value encoded as
+// JSON.
+func jsonFieldString(value any) (string, error) {
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+	return encodeJSON(value)
+}
+
+// encodeJSON encodes value as JSON without escaping HTML characters.
+func encodeJSON(value any) (string, error) {
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(out.String(), "\n"), nil
+}
+
+// scaleNumber parses payload as a number and returns value*scale + offset.
+func scaleNumber(payload string, scale float64, offset float64) (float64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(payload), 64)
+	if err != nil {
+		return 0, fmt.Errorf("payload %q is not a number", payload)
+	}
+	return value*scale + offset, nil
+}
+
+// validateNumberFormat returns the problems found in the decimals, round and
+// format of r, which are alternative ways of formatting numbers.
+func (r Remap) validateNumberFormat() []error {
+	var errs []error
+	if r.Round != nil && *r.Round < 0 {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid round %d (must not be negative)", r.From, *r.Round))
+	}
+	if (r.Decimals != nil && r.Round != nil) || (r.Decimals != nil && r.Format != "") || (r.Round != nil && r.Format != "") {
+		errs = append(errs, fmt.Errorf("remap from %s: decimals, round and format can't be used together", r.From))
+	}
+	// The fmt package reports the problems of a format in its output.
+	if r.Format != "" && strings.Contains(fmt.Sprintf(r.Format, 1.5), "%!") {
+		errs = append(errs, fmt.Errorf("remap from %s: invalid format %q (must contain a single verb formatting a number, e.g. %%.2f)", r.From, r.Format))
+	}
+	return errs
+}
+
+// formatNumber formats the result of the numeric transform with the format,
+// round or decimals of r, or in its shortest representation.
+func (r Remap) formatNumber(value float64) string {
+	switch {
+	case r.Format != "":
+		return fmt.Sprintf(r.Format, value)
+	case r.Round != nil:
+		formatted := strconv.FormatFloat(value, 'f', *r.Round, 64)
+		if strings.Contains(formatted, ".") {
+			formatted = strings.TrimRight(strings.TrimRight(formatted, "0"), ".")
+		}
+		if formatted == "-0" {
+			return "0"
+		}
+		return formatted
+	case r.Decimals != nil:
+		return strconv.FormatFloat(value, 'f', *r.Decimals, 64)
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// formatJSON compacts or indents a JSON payload, returning payloads that aren't
+// valid JSON unchanged.
+func (r Remap) formatJSON(payload string) string {
+	var out bytes.Buffer
+	var err error
+	if r.JSONPretty {
+		err = json.Indent(&out, []byte(payload), "", "  ")
+	} else {
+		err = json.Compact(&out, []byte(payload))
+	}
+	if err != nil {
+		r.logger().Debug("Not formatting payload that isn't valid JSON", "from", r.From, "error", err)
+		return payload
+	}
+	return out.String()
+}
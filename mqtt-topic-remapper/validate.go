@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// reportedOptions are the routing options the validation report has its own
+// lines for, either for the destinations or the transforms.
+var reportedOptions = []string{
+	"to, split or routes",
+	"from_regex, subscribe or shared_group",
+	"sub_qos or pub_qos",
+	"retained or retain_from_source",
+	"strip_prefix or add_prefix",
+	"batch",
+	"merge",
+	"else_to",
+	"pipeline",
+	"decompress or compress",
+	"base64_encode or base64_decode",
+}
+
+// printValidationReport writes the report of the validate command to w: the
+// remaps of config with their subscription, destinations and resolved
+// transforms, followed by the problems found in err, as returned by
+// loadConfig.
+func printValidationReport(w io.Writer, file string, config Config, err error) {
+	fmt.Fprintf(w, "Config %s\n", file)
+	for i, remap := range config.Remaps {
+		fmt.Fprintf(w, "\nRemap %d of %d: %s\n", i+1, len(config.Remaps), remap.tag())
+		line := func(label string, values ...string) {
+			if len(values) > 0 {
+				fmt.Fprintf(w, "  %-11s %s\n", label+":", strings.Join(values, "\n              "))
+			}
+		}
+		line("file", remap.file)
+		line("from", remap.From+remap.fromKind())
+		line("subscribe", fmt.Sprintf("%s (qos %d)", remap.subscription(), remap.SubQoS))
+		line("to", remap.destinationSummary()...)
+		line("transforms", remap.transformSteps()...)
+		var options []string
+		for _, option := range remap.routingOptions() {
+			if !slices.Contains(reportedOptions, option) {
+				options = append(options, option)
+			}
+		}
+		line("options", options...)
+	}
+	for _, batch := range config.Batches {
+		fmt.Fprintf(w, "\nBatch %s: to %s every %s\n", batch.Name, batch.To, batch.Interval)
+	}
+	for _, merge := range config.Merges {
+		fmt.Fprintf(w, "\nMerge %s: to %s\n", merge.Name, merge.To)
+	}
+
+	problems := flattenErrors(err)
+	if len(problems) == 0 {
+		fmt.Fprintf(w, "\nConfig is valid: %d remaps, %d disabled\n", len(config.Remaps), config.disabledRemaps)
+		return
+	}
+	fmt.Fprintf(w, "\n%d problems found:\n", len(problems))
+	for _, problem := range problems {
+		fmt.Fprintf(w, "  - %s\n", strings.ReplaceAll(problem.Error(), "\n", "\n    "))
+	}
+}
+
+// fromKind describes how the from of r is matched, if it isn't a topic.
+func (r Remap) fromKind() string {
+	switch {
+	case r.FromRegex:
+		return " (regex)"
+	case isWildcardTopic(r.From):
+		return " (wildcard)"
+	}
+	return ""
+}
+
+// destinationSummary describes where r publishes the remapped messages.
+func (r Remap) destinationSummary() []string {
+	var summary []string
+	for _, destination := range r.To {
+		qos, retained := r.PubQoS, r.Retained
+		if destination.PubQoS != nil {
+			qos = *destination.PubQoS
+		}
+		if destination.Retained != nil {
+			retained = *destination.Retained
+		}
+		details := fmt.Sprintf("qos %d", qos)
+		if r.RetainFromSource {
+			details += ", retained from source"
+		} else if retained {
+			details += ", retained"
+		}
+		if destination.topicTemplate != nil {
+			details += ", rendered from payload"
+		}
+		if len(destination.ValueMappings) > 0 {
+			details += fmt.Sprintf(", %d value mappings", len(destination.ValueMappings))
+		}
+		summary = append(summary, fmt.Sprintf("%s (%s)", destination.Topic, details))
+	}
+	if r.StripPrefix != "" || r.AddPrefix != "" {
+		summary = append(summary, fmt.Sprintf("incoming topic without prefix %q, with prefix %q", r.StripPrefix, r.AddPrefix))
+	}
+	for _, field := range sortedKeys(r.Split) {
+		summary = append(summary, fmt.Sprintf("%s (split field %s)", r.Split[field], field))
+	}
+	for _, route := range r.Routes {
+		switch {
+		case route.When != nil:
+			summary = append(summary, fmt.Sprintf("%s (route when %q)", route.To, *route.When))
+		case route.Condition != "":
+			summary = append(summary, fmt.Sprintf("%s (route condition %q)", route.To, route.Condition))
+		default:
+			summary = append(summary, fmt.Sprintf("%s (default route)", route.To))
+		}
+	}
+	if r.ElseTo != "" {
+		summary = append(summary, fmt.Sprintf("%s (else_to, condition not met)", r.ElseTo))
+	}
+	if r.Batch != "" {
+		summary = append(summary, fmt.Sprintf("batch %s", r.Batch))
+	}
+	if r.Merge != "" {
+		summary = append(summary, fmt.Sprintf("merge %s as %s", r.Merge, r.MergeField))
+	}
+	return summary
+}
+
+// flattenErrors returns the problems contained in an error returned by
+// loadConfig, which joins them.
+func flattenErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) {
+		return []error{err}
+	}
+	var errs []error
+	for _, err := range joined.Unwrap() {
+		errs = append(errs, flattenErrors(err)...)
+	}
+	return errs
+}